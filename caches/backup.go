@@ -0,0 +1,276 @@
+package caches
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/radozd/goutils/files"
+)
+
+// snapshots with this suffix are zstd compressed
+const backupZstdExt = ".zst"
+
+// Backup writes a consistent copy of the live database to dst.
+// The copy is zstd compressed if dst ends with ".zst".
+func (c *PermanentCache) Backup(ctx context.Context, dst string) error {
+	compress := strings.HasSuffix(dst, backupZstdExt)
+
+	tmp := dst + ".tmp"
+	if compress {
+		tmp = strings.TrimSuffix(dst, backupZstdExt) + ".tmp"
+	}
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	// Restore replaces c.DB
+	c.lock.RLock()
+	_, err := c.DB.ExecContext(ctx, "VACUUM INTO ?", tmp)
+	c.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if compress {
+		packed := dst + ".tmp"
+		defer os.Remove(packed)
+		if err := compressFile(ctx, tmp, packed); err != nil {
+			return err
+		}
+		tmp = packed
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	log.Println("DB: backup " + c.dbpath + " to " + dst)
+	return nil
+}
+
+// fixed width, so snapshot names sort by time
+const snapshotTime = "20060102-150405.000"
+
+// BackupRotate writes a timestamped snapshot to dir and deletes
+// all but the last keep snapshots. Returns the path of the snapshot.
+func (c *PermanentCache) BackupRotate(ctx context.Context, dir string, keep int, compress bool) (string, error) {
+	base := strings.TrimSuffix(filepath.Base(c.dbpath), filepath.Ext(c.dbpath))
+	ext := ".db"
+	if compress {
+		ext += backupZstdExt
+	}
+	// a later millisecond if a snapshot of this one exists, names keep their order
+	tm := time.Now()
+	dst := filepath.Join(dir, base+"-"+tm.Format(snapshotTime)+ext)
+	for files.Exists(dst) {
+		tm = tm.Add(time.Millisecond)
+		dst = filepath.Join(dir, base+"-"+tm.Format(snapshotTime)+ext)
+	}
+	if err := c.Backup(ctx, dst); err != nil {
+		return "", err
+	}
+
+	var snapshots []string
+	// second resolution names of older versions are rotated too
+	for _, pattern := range []string{"-????????-??????.db*", "-????????-??????.???.db*"} {
+		found, err := filepath.Glob(filepath.Join(dir, base+pattern))
+		if err != nil {
+			return dst, err
+		}
+		snapshots = append(snapshots, found...)
+	}
+	snapshots = filterSnapshots(snapshots)
+	// timestamps sort as strings
+	sort.Strings(snapshots)
+	for len(snapshots) > keep && keep > 0 {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return dst, err
+		}
+		snapshots = snapshots[1:]
+	}
+	return dst, nil
+}
+
+func filterSnapshots(paths []string) []string {
+	res := paths[:0]
+	for _, p := range paths {
+		if strings.HasSuffix(p, ".db") || strings.HasSuffix(p, ".db"+backupZstdExt) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Restore replaces the database with a snapshot made by Backup.
+// The snapshot is checked first, the cache is reopened afterwards.
+func (c *PermanentCache) Restore(ctx context.Context, src string) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+
+	tmp := c.dbpath + ".restore"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	var err error
+	if strings.HasSuffix(src, backupZstdExt) {
+		err = decompressFile(ctx, src, tmp)
+	} else {
+		err = copyFile(src, tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if err = validateSnapshot(ctx, tmp); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.touchLock.Lock()
+	c.touched = nil
+	c.touchLock.Unlock()
+
+	c.DB.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+	c.DB.Close()
+	os.Remove(c.dbpath + "-wal")
+	os.Remove(c.dbpath + "-shm")
+
+	if err = os.Rename(tmp, c.dbpath); err != nil {
+		// keep the cache usable with the old data
+		if oerr := c.Open(); oerr != nil {
+			log.Println("DB: reopen failed:", oerr)
+		}
+		return err
+	}
+	log.Println("DB: restored " + c.dbpath + " from " + src)
+	if err = c.Open(); err != nil {
+		return err
+	}
+	_, err = c.DB.Exec("PRAGMA journal_mode=WAL;")
+	return err
+}
+
+func validateSnapshot(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var check string
+	if err = db.QueryRowContext(ctx, "PRAGMA integrity_check;").Scan(&check); err != nil {
+		return err
+	}
+	if check != "ok" {
+		return fmt.Errorf("integrity check failed: %s", check)
+	}
+
+	var version int
+	if err = db.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+	if version > SchemaVersion() {
+		return &SchemaError{Path: path, Version: version, Supported: SchemaVersion()}
+	}
+
+	var tables int
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='cache'").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("not a cache database")
+	}
+	return nil
+}
+
+// ctxReader stops copying when the context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func compressFile(ctx context.Context, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w, err := NewZstdWriter(out, zstd.SpeedDefault)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, ctxReader{ctx, in}); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func decompressFile(ctx context.Context, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := NewZstdReader(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, ctxReader{ctx, r}); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,434 @@
+package caches
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// execer is implemented by *sql.DB, *sql.Tx and txStmts.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// writeTx runs fn in a transaction, so a failed write leaves nothing behind.
+// While the database is busy the whole transaction is repeated.
+func (c *PermanentCache) writeTx(fn func(tx *sql.Tx) error) error {
+	return c.retryBusy(func() error {
+		tx, err := c.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if err = fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// txStmts prepares every distinct statement once per transaction.
+type txStmts struct {
+	*sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func newTxStmts(tx *sql.Tx) *txStmts {
+	return &txStmts{Tx: tx, stmts: make(map[string]*sql.Stmt)}
+}
+
+func (t *txStmts) stmt(query string) (*sql.Stmt, error) {
+	if st, ok := t.stmts[query]; ok {
+		return st, nil
+	}
+	st, err := t.Tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	t.stmts[query] = st
+	return st, nil
+}
+
+func (t *txStmts) Exec(query string, args ...any) (sql.Result, error) {
+	st, err := t.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.Exec(args...)
+}
+
+func (t *txStmts) Query(query string, args ...any) (*sql.Rows, error) {
+	st, err := t.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.Query(args...)
+}
+
+func (t *txStmts) QueryRow(query string, args ...any) *sql.Row {
+	st, err := t.stmt(query)
+	if err != nil {
+		// the error is reported by Scan
+		return t.Tx.QueryRow(query, args...)
+	}
+	return st.QueryRow(args...)
+}
+
+func (t *txStmts) close() {
+	for _, st := range t.stmts {
+		st.Close()
+	}
+	t.stmts = nil
+}
+
+// Batch groups changes into a single transaction. It holds the write lock
+// of the cache until Commit or Rollback, other callers wait.
+type Batch struct {
+	c  *PermanentCache
+	tx *txStmts
+	// delivered to watchers on Commit
+	events []Event
+}
+
+func (c *PermanentCache) NewBatch() (*Batch, error) {
+	if err := c.writable(); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	var tx *sql.Tx
+	err := c.retryBusy(func() (err error) {
+		if tx, err = c.DB.Begin(); err != nil {
+			return err
+		}
+		// take the write lock now, a deferred transaction which has read
+		// fails without waiting when another writer commits in between
+		if _, err = tx.Exec("DELETE FROM cache WHERE 0"); err != nil {
+			tx.Rollback()
+		}
+		return err
+	})
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	return &Batch{c: c, tx: newTxStmts(tx)}, nil
+}
+
+// Put stores data with DefaultTTL. Compression happens under the lock,
+// PutMany compresses in parallel before locking.
+func (b *Batch) Put(key string, comment string, data []byte, compress string) error {
+	return b.PutTTL(key, comment, data, compress, b.c.DefaultTTL)
+}
+
+// PutTTL stores data which expires after ttl, zero means never.
+func (b *Batch) PutTTL(key string, comment string, data []byte, compress string, ttl time.Duration) error {
+	sv, err := b.c.prepareValue(compress, data)
+	if err != nil {
+		return err
+	}
+	return b.put(key, comment, sv, ttl)
+}
+
+func (b *Batch) put(key string, comment string, sv storedValue, ttl time.Duration) error {
+	if err := b.c.insertRow(b.tx, key, comment, sv, ttl); err != nil {
+		return err
+	}
+	b.events = append(b.events, Event{Type: EventPut, Key: key})
+	return nil
+}
+
+func (b *Batch) Remove(key string) (bool, error) {
+	removed, err := b.c.deleteRow(b.tx, key)
+	if removed && err == nil {
+		b.events = append(b.events, Event{Type: EventRemove, Key: key})
+	}
+	return removed, err
+}
+
+// SetTags replaces tags of a key stored before or by the batch.
+func (b *Batch) SetTags(key string, tags ...string) error {
+	return b.c.writeTags(b.tx, key, true, tags)
+}
+
+// SetAttrs replaces attributes of the key, nil removes them.
+func (b *Batch) SetAttrs(key string, attrs map[string]any) error {
+	js, err := attrsJSON(attrs)
+	if err != nil {
+		return err
+	}
+	return updateExec(b.tx, key, setAttrsQuery, js)
+}
+
+// Get sees changes made by the batch.
+func (b *Batch) Get(key string) ([]byte, error) {
+	data, _, err := b.c.readRow(b.tx, key)
+	return data, err
+}
+
+func (b *Batch) Commit() error {
+	if b.tx == nil {
+		return sql.ErrTxDone
+	}
+	defer b.done()
+
+	b.tx.close()
+	if err := b.tx.Commit(); err != nil {
+		return err
+	}
+	for _, e := range b.events {
+		b.c.notify(e.Type, e.Key)
+	}
+	b.c.evictAfterWrite()
+	return nil
+}
+
+func (b *Batch) Rollback() error {
+	if b.tx == nil {
+		return sql.ErrTxDone
+	}
+	defer b.done()
+
+	b.tx.close()
+	return b.tx.Rollback()
+}
+
+func (b *Batch) done() {
+	b.tx = nil
+	b.c.lock.Unlock()
+}
+
+// PutMany stores entries atomically, Entry.Kind selects compression.
+func (c *PermanentCache) PutMany(entries []Entry) error {
+	values := make([]storedValue, len(entries))
+	errs := make([]error, len(entries))
+
+	// compress outside of the lock
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				values[i], errs[i] = c.prepareValue(entries[i].Kind, entries[i].Value)
+			}
+		}()
+	}
+	for i := range entries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := c.NewBatch()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if err = b.put(e.Key, e.Comment, values[i], c.DefaultTTL); err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// GetMany returns found keys only.
+func (c *PermanentCache) GetMany(keys []string) (map[string][]byte, error) {
+	c.lock.RLock()
+	res := make(map[string][]byte, len(keys))
+	tx, err := c.DB.Begin()
+	if err == nil {
+		stmts := newTxStmts(tx)
+		for _, key := range keys {
+			var data []byte
+			var found bool
+			if data, found, err = c.readRow(stmts, key); err != nil {
+				break
+			}
+			if found {
+				res[key] = data
+			}
+		}
+		stmts.close()
+		tx.Rollback()
+	}
+	c.lock.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+	for key := range res {
+		c.touch(key)
+	}
+	return res, nil
+}
+
+// RemoveMany deletes keys atomically and returns the number of removed entries.
+func (c *PermanentCache) RemoveMany(keys []string) (int, error) {
+	b, err := c.NewBatch()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, key := range keys {
+		ok, err := b.Remove(key)
+		if err != nil {
+			b.Rollback()
+			return 0, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, b.Commit()
+}
+
+// rawRow is a row as stored, before decryption and decoding.
+type rawRow struct {
+	id       int64
+	key      string
+	kind     string
+	keyid    string
+	value    []byte
+	checksum []byte
+}
+
+// rewriteRows passes every row of cache, history and blobs to fn in batches of 100 rows
+// per transaction. Rows for which fn returns a value are updated.
+// Returns the number of updated rows.
+func (c *PermanentCache) rewriteRows(ctx context.Context, fn func(r *rawRow) (*storedValue, error)) (int, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, t := range []rewriteTable{rewriteCache, rewriteHistory, rewriteBlobs} {
+		var last int64
+		for {
+			if err := ctx.Err(); err != nil {
+				return total, err
+			}
+			n, next, err := c.rewriteBatch(t, fn, last, 100)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if next == last {
+				break
+			}
+			last = next
+		}
+	}
+	return total, nil
+}
+
+type rewriteTable struct {
+	query  string
+	update func(tx execer, r *rawRow, sv *storedValue) error
+}
+
+var (
+	rewriteCache = rewriteTable{
+		query: "SELECT rowid, key, kind, COALESCE(keyid, ''), value, checksum FROM cache WHERE rowid > ? AND value IS NOT NULL ORDER BY rowid LIMIT ?",
+		update: func(tx execer, r *rawRow, sv *storedValue) error {
+			_, err := tx.Exec("UPDATE cache SET kind=?, value=?, size=?, keyid=?, checksum=? WHERE rowid=?",
+				sv.kind, sv.value, len(sv.value), sv.nullKeyID(), sv.checksum, r.id)
+			return err
+		},
+	}
+	rewriteHistory = rewriteTable{
+		query: "SELECT rowid, key, kind, COALESCE(keyid, ''), value, checksum FROM history WHERE rowid > ? AND value IS NOT NULL ORDER BY rowid LIMIT ?",
+		update: func(tx execer, r *rawRow, sv *storedValue) error {
+			_, err := tx.Exec("UPDATE history SET kind=?, value=?, keyid=?, checksum=? WHERE rowid=?",
+				sv.kind, sv.value, sv.nullKeyID(), sv.checksum, r.id)
+			return err
+		},
+	}
+	// deduplicated values, checksum is the hash
+	rewriteBlobs = rewriteTable{
+		query:  "SELECT rowid, hex(hash), kind, COALESCE(keyid, ''), value, hash FROM blobs WHERE rowid > ? ORDER BY rowid LIMIT ?",
+		update: rehashBlob,
+	}
+)
+
+// rehashBlob updates the blob in place or, if its hash has changed,
+// moves the references to a new blob. Triggers delete the old one.
+func rehashBlob(tx execer, r *rawRow, sv *storedValue) error {
+	if bytes.Equal(sv.checksum, r.checksum) {
+		_, err := tx.Exec("UPDATE blobs SET kind=?, value=?, size=?, keyid=? WHERE rowid=?",
+			sv.kind, sv.value, len(sv.value), sv.nullKeyID(), r.id)
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO blobs(hash, refs, kind, keyid, value, size) VALUES(?,0,?,?,?,?) ON CONFLICT(hash) DO NOTHING",
+		sv.checksum, sv.kind, sv.nullKeyID(), sv.value, len(sv.value)); err != nil {
+		return err
+	}
+	for _, table := range []string{"history", "cache"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET blob=?, checksum=? WHERE blob=?", sv.checksum, sv.checksum, r.checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *PermanentCache) rewriteBatch(t rewriteTable, fn func(r *rawRow) (*storedValue, error), after int64, limit int) (int, int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var updated int
+	last := after
+	err := c.writeTx(func(tx *sql.Tx) error {
+		updated, last = 0, after
+		rows, err := tx.Query(t.query, after, limit)
+		if err != nil {
+			return err
+		}
+
+		var updates []*rawRow
+		var values []*storedValue
+		for rows.Next() {
+			var r rawRow
+			if err = rows.Scan(&r.id, &r.key, &r.kind, &r.keyid, &r.value, &r.checksum); err != nil {
+				rows.Close()
+				return err
+			}
+			last = r.id
+
+			sv, err := fn(&r)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if sv != nil {
+				updates = append(updates, &r)
+				values = append(values, sv)
+			}
+		}
+		rows.Close()
+
+		for i, r := range updates {
+			if err = t.update(tx, r, values[i]); err != nil {
+				return err
+			}
+		}
+		updated = len(updates)
+		return nil
+	})
+	if err != nil {
+		return 0, after, err
+	}
+	return updated, last, nil
+}
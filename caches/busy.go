@@ -0,0 +1,85 @@
+package caches
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrReadOnly = errors.New("cache is opened read-only")
+	ErrBusy     = errors.New("cache is locked by another writer")
+)
+
+// BusyError is returned when a write still fails with SQLITE_BUSY after all retries,
+// usually because another process holds the write lock.
+type BusyError struct {
+	Path    string
+	Retries int
+	Err     error
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s: locked by another writer, %d retries failed: %v", e.Path, e.Retries, e.Err)
+}
+
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+func (e *BusyError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	defaultBusyTimeout = 5 * time.Second
+	maxBusyBackoff     = 2 * time.Second
+)
+
+// dsn builds the sqlite uri with per-connection pragmas.
+func (c *PermanentCache) dsn() string {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", c.BusyTimeout.Milliseconds()))
+	if c.ReadOnly {
+		q.Set("mode", "ro")
+	}
+	u := url.URL{Path: filepath.ToSlash(c.dbpath)}
+	return "file:" + u.EscapedPath() + "?" + q.Encode()
+}
+
+func (c *PermanentCache) writable() error {
+	if c.ReadOnly {
+		return fmt.Errorf("%s: %w", c.dbpath, ErrReadOnly)
+	}
+	return nil
+}
+
+// isBusy matches SQLITE_BUSY and SQLITE_LOCKED including extended codes.
+func isBusy(err error) bool {
+	var e interface{ Code() int }
+	if !errors.As(err, &e) {
+		return false
+	}
+	code := e.Code() & 0xff
+	return code == 5 || code == 6
+}
+
+// retryBusy repeats op with growing pauses while the database is busy.
+func (c *PermanentCache) retryBusy(op func() error) error {
+	backoff := 50 * time.Millisecond
+	for i := 0; ; i++ {
+		err := op()
+		if !isBusy(err) {
+			return err
+		}
+		if i >= c.BusyRetries {
+			return &BusyError{Path: c.dbpath, Retries: i, Err: err}
+		}
+		log.Printf("DB: %s is busy, retry in %v", c.dbpath, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBusyBackoff)
+	}
+}
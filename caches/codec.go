@@ -0,0 +1,265 @@
+package caches
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses cache values. Name is stored in the kind column
+// of PermanentCache and in tar headers of TarCache.
+type Codec interface {
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// ZipCodec is implemented by codecs that have a zip method id.
+type ZipCodec interface {
+	Codec
+	ZipMethod() uint16
+}
+
+// LevelCodec is implemented by codecs with selectable compression level.
+// Level numbers follow the native library, e.g. 1..22 for zstd.
+type LevelCodec interface {
+	Codec
+	EncodeLevel(src []byte, level int) ([]byte, error)
+}
+
+var ErrUnknownCodec = errors.New("unknown compression type")
+
+type UnknownCodecError struct {
+	Kind string
+}
+
+func (e *UnknownCodecError) Error() string {
+	return fmt.Sprintf("unknown compression type %q", e.Kind)
+}
+
+func (e *UnknownCodecError) Unwrap() error {
+	return ErrUnknownCodec
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(rawCodec{})
+	RegisterCodec(zlibCodec{})
+	RegisterCodec(zstdCodec{})
+	RegisterCodec(flateCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(s2Codec{})
+	RegisterCodec(snappyCodec{})
+}
+
+// RegisterCodec adds or replaces a codec, e.g. brotli or lz4 provided by the application.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func LookupCodec(kind string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	if c, ok := codecs[kind]; ok {
+		return c, nil
+	}
+	return nil, &UnknownCodecError{Kind: kind}
+}
+
+// Codecs lists names of registered codecs.
+func Codecs() []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readAllClose(r io.ReadCloser) ([]byte, error) {
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, r); err != nil {
+		r.Close()
+		return nil, err
+	}
+	err := r.Close()
+	return out.Bytes(), err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// no compression
+type rawCodec struct{}
+
+func (rawCodec) Name() string                                  { return "" }
+func (rawCodec) ZipMethod() uint16                             { return 0 }
+func (rawCodec) Encode(src []byte) ([]byte, error)             { return src, nil }
+func (rawCodec) Decode(src []byte) ([]byte, error)             { return src, nil }
+func (rawCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+func (rawCodec) NewReader(r io.Reader) (io.ReadCloser, error)  { return io.NopCloser(r), nil }
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string                                  { return "zlib" }
+func (zlibCodec) Encode(src []byte) ([]byte, error)             { return ZlibPack(src) }
+func (zlibCodec) Decode(src []byte) ([]byte, error)             { return ZlibUnpack(src) }
+func (zlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil }
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error)  { return zlib.NewReader(r) }
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string                      { return "zstd" }
+func (zstdCodec) ZipMethod() uint16                 { return 93 }
+func (zstdCodec) Encode(src []byte) ([]byte, error) { return ZstdPack(src) }
+func (zstdCodec) Decode(src []byte) ([]byte, error) { return ZstdUnpack(src) }
+
+func (zstdCodec) EncodeLevel(src []byte, level int) ([]byte, error) {
+	return ZstdPackLevel(src, zstd.EncoderLevelFromZstd(level))
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return NewZstdWriter(w, zstd.SpeedBestCompression)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return NewZstdReader(r)
+}
+
+// raw deflate, as used by zip
+type flateCodec struct{}
+
+func (flateCodec) Name() string      { return "flate" }
+func (flateCodec) ZipMethod() uint16 { return 8 }
+
+func (c flateCodec) Encode(src []byte) ([]byte, error) { return encodeStream(c, src) }
+func (c flateCodec) Decode(src []byte) ([]byte, error) { return decodeStream(c, src) }
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.BestCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (c gzipCodec) Encode(src []byte) ([]byte, error) { return encodeStream(c, src) }
+func (c gzipCodec) Decode(src []byte) ([]byte, error) { return decodeStream(c, src) }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// s2 block format for values, framed format for streams
+type s2Codec struct{}
+
+func (s2Codec) Name() string                      { return "s2" }
+func (s2Codec) Encode(src []byte) ([]byte, error) { return s2.EncodeBetter(nil, src), nil }
+func (s2Codec) Decode(src []byte) ([]byte, error) { return s2.Decode(nil, src) }
+
+func (s2Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w, s2.WriterBetterCompression()), nil
+}
+
+func (s2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(r)), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string                      { return "snappy" }
+func (snappyCodec) Encode(src []byte) ([]byte, error) { return snappy.Encode(nil, src), nil }
+func (snappyCodec) Decode(src []byte) ([]byte, error) { return snappy.Decode(nil, src) }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w, s2.WriterSnappyCompat()), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(snappy.NewReader(r)), nil
+}
+
+func encodeStream(c Codec, src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := c.NewWriter(&b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		w.Close()
+		return nil, err
+	}
+	err = w.Close()
+	return b.Bytes(), err
+}
+
+func decodeStream(c Codec, src []byte) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readAllClose(r)
+}
+
+// codec resolves the kind column of a row.
+func (c *PermanentCache) codec(kind string) (Codec, error) {
+	if kind == KindZstdDict {
+		if dict := c.dict.Load(); dict != nil {
+			return dict, nil
+		}
+		return nil, ErrNoDictionary
+	}
+	return LookupCodec(kind)
+}
+
+func (c *PermanentCache) encode(kind string, data []byte) ([]byte, error) {
+	codec, err := c.codec(kind)
+	if err != nil {
+		return nil, err
+	}
+	if lc, ok := codec.(LevelCodec); ok && c.Level != 0 {
+		return lc.EncodeLevel(data, c.Level)
+	}
+	return codec.Encode(data)
+}
+
+func (c *PermanentCache) decode(kind string, value []byte) ([]byte, error) {
+	codec, err := c.codec(kind)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(value)
+}
@@ -0,0 +1,113 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+type computeCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type failedCall struct {
+	err   error
+	until time.Time
+}
+
+// GetOrCompute returns the cached value or stores the result of load.
+// Concurrent callers missing the same key share a single load call.
+// Cancelling ctx stops waiting, but the load goes on for other callers.
+// A panic in load is returned as an error. If the value cannot be stored,
+// the loaded data is returned together with the error.
+func (c *PermanentCache) GetOrCompute(ctx context.Context, key string, load func() ([]byte, error)) ([]byte, error) {
+	if data, found, err := c.Lookup(key); found || err != nil {
+		return data, err
+	}
+
+	c.flightLock.Lock()
+	if f, ok := c.failed[key]; ok {
+		if time.Now().Before(f.until) {
+			c.flightLock.Unlock()
+			return nil, f.err
+		}
+		delete(c.failed, key)
+	}
+	call, ok := c.calls[key]
+	if !ok {
+		if c.calls == nil {
+			c.calls = make(map[string]*computeCall)
+		}
+		call = &computeCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.compute(key, call, load)
+	}
+	c.flightLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.data, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *PermanentCache) compute(key string, call *computeCall, load func() ([]byte, error)) {
+	defer func() {
+		// load runs in its own goroutine, nobody else could recover
+		if r := recover(); r != nil {
+			log.Printf("DB: load of %q panicked: %v\n%s", key, r, debug.Stack())
+			call.data, call.err = nil, fmt.Errorf("load of %q panicked: %v", key, r)
+		}
+		c.flightLock.Lock()
+		delete(c.calls, key)
+		c.flightLock.Unlock()
+		close(call.done)
+	}()
+
+	// the previous call could have stored the value right after our miss
+	data, found, err := c.Lookup(key)
+	if found || err != nil {
+		call.data, call.err = data, err
+		return
+	}
+
+	if data, err = load(); err != nil {
+		call.err = err
+		if c.NegativeTTL > 0 {
+			c.flightLock.Lock()
+			if c.failed == nil {
+				c.failed = make(map[string]failedCall)
+			}
+			c.failed[key] = failedCall{err: err, until: time.Now().Add(c.NegativeTTL)}
+			c.pruneFailed()
+			c.flightLock.Unlock()
+		}
+		return
+	}
+	call.data = data
+	call.err = c.Put(key, "", data, c.ComputeCompress)
+}
+
+// minPruneAt keeps small maps from being pruned on every failure
+const minPruneAt = 64
+
+// pruneFailed drops expired failures of keys never asked again. It runs when the map
+// has doubled since the last pass, so the cost per failure stays constant.
+// It expects flightLock to be held.
+func (c *PermanentCache) pruneFailed() {
+	if len(c.failed) < max(c.pruneAt, minPruneAt) {
+		return
+	}
+	now := time.Now()
+	for key, f := range c.failed {
+		if !now.Before(f.until) {
+			delete(c.failed, key)
+		}
+	}
+	c.pruneAt = 2 * len(c.failed)
+}
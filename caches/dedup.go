@@ -0,0 +1,60 @@
+package caches
+
+import "database/sql"
+
+type DedupStats struct {
+	Keys  int64
+	Blobs int64
+	// LogicalBytes is the stored size of all deduplicated keys,
+	// StoredBytes the size of their blobs.
+	LogicalBytes int64
+	StoredBytes  int64
+}
+
+func (s DedupStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+func (c *PermanentCache) DedupStats() (DedupStats, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var s DedupStats
+	if err := c.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM cache WHERE blob IS NOT NULL").Scan(&s.Keys, &s.LogicalBytes); err != nil {
+		return s, err
+	}
+	err := c.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&s.Blobs, &s.StoredBytes)
+	return s, err
+}
+
+// CollectBlobs recounts references and deletes unreferenced blobs.
+// Triggers keep the counts, so it is only needed after manual edits.
+func (c *PermanentCache) CollectBlobs() (int64, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var n int64
+	err := c.writeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE blobs SET refs=(SELECT COUNT(*) FROM cache WHERE cache.blob=blobs.hash)
+		+ (SELECT COUNT(*) FROM history WHERE history.blob=blobs.hash)`); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM blobs WHERE refs<=0")
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,188 @@
+package caches
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// KindZstdDict marks values compressed with a trained dictionary.
+// The dictionary id is stored in the zstd frame, so values written
+// with older dictionaries stay readable.
+const KindZstdDict = "zstd.dict"
+
+var ErrNoDictionary = errors.New("no zstd dictionary in cache")
+
+// zstd reserves ids below 32768
+const dictIDBase = 32768
+
+type zstdDictCodec struct {
+	version int
+	latest  []byte
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+}
+
+func newZstdDictCodec(version int, dicts [][]byte) (*zstdDictCodec, error) {
+	latest := dicts[len(dicts)-1]
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderDict(latest))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdDictCodec{version: version, latest: latest, enc: enc, dec: dec}, nil
+}
+
+func (d *zstdDictCodec) Name() string                      { return KindZstdDict }
+func (d *zstdDictCodec) Encode(src []byte) ([]byte, error) { return d.enc.EncodeAll(src, nil), nil }
+func (d *zstdDictCodec) Decode(src []byte) ([]byte, error) { return d.dec.DecodeAll(src, nil) }
+
+func (d *zstdDictCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderDict(d.latest))
+}
+
+func (d *zstdDictCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderDicts(d.latest))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+func (c *PermanentCache) loadDicts() error {
+	rows, err := c.DB.Query("SELECT id, dict FROM dicts ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var version int
+	var dicts [][]byte
+	for rows.Next() {
+		var d []byte
+		if err = rows.Scan(&version, &d); err != nil {
+			return err
+		}
+		dicts = append(dicts, d)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(dicts) == 0 {
+		c.dict.Store(nil)
+		return nil
+	}
+
+	codec, err := newZstdDictCodec(version, dicts)
+	if err != nil {
+		return err
+	}
+	c.dict.Store(codec)
+	return nil
+}
+
+// DictVersion returns the version of the latest dictionary, zero if none.
+func (c *PermanentCache) DictVersion() int {
+	if d := c.dict.Load(); d != nil {
+		return d.version
+	}
+	return 0
+}
+
+// TrainDict builds a new dictionary of up to maxSize bytes from
+// a random sample of entries and returns its version.
+func (c *PermanentCache) TrainDict(samples int, maxSize int) (int, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rows, err := c.DB.Query("SELECT key, kind, COALESCE(keyid, ''), value FROM entries WHERE value IS NOT NULL ORDER BY RANDOM() LIMIT ?", samples)
+	if err != nil {
+		return 0, err
+	}
+	var input [][]byte
+	for rows.Next() {
+		var key, kind, keyid string
+		var value []byte
+		if err = rows.Scan(&key, &kind, &keyid, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		data, err := c.decodeRow(key, kind, keyid, value, nil, false)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		input = append(input, data)
+	}
+	rows.Close()
+
+	version := c.DictVersion() + 1
+	d, err := dict.BuildZstdDict(input, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+		ZstdDictID:  uint32(dictIDBase + version),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.retryBusy(func() error {
+		_, err := c.DB.Exec("INSERT INTO dicts(id, dict) VALUES(?,?)", version, d)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = c.loadDicts(); err != nil {
+		return 0, err
+	}
+	log.Printf("DB: dictionary %d trained on %d entries, %d bytes", version, len(input), len(d))
+	return version, nil
+}
+
+// Recompress rewrites all values with the given compression kind,
+// e.g. KindZstdDict after TrainDict. Returns the number of rewritten rows.
+func (c *PermanentCache) Recompress(ctx context.Context, kind string) (int, error) {
+	if _, err := c.codec(kind); err != nil {
+		return 0, err
+	}
+	latest := uint32(dictIDBase + c.DictVersion())
+
+	return c.rewriteRows(ctx, func(r *rawRow) (*storedValue, error) {
+		if r.kind == kind {
+			if kind != KindZstdDict {
+				return nil, nil
+			}
+			value, err := c.unseal(r.key, r.kind, r.keyid, r.value, r.checksum)
+			if err != nil || frameDictID(value) == latest {
+				return nil, err
+			}
+		}
+		data, err := c.decodeRow(r.key, r.kind, r.keyid, r.value, r.checksum, false)
+		if err != nil {
+			return nil, err
+		}
+		sv, err := c.prepareValue(kind, data)
+		return &sv, err
+	})
+}
+
+// frameDictID reads the dictionary id from the frame header without decoding
+func frameDictID(value []byte) uint32 {
+	var hdr zstd.Header
+	if hdr.Decode(value) != nil {
+		return 0
+	}
+	return hdr.DictionaryID
+}
@@ -0,0 +1,166 @@
+package caches
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// KeyProvider supplies encryption keys. Key ids are stored with every
+// encrypted row, so old keys must stay available until ReEncrypt is done.
+type KeyProvider interface {
+	// CurrentKey is used for new values.
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider for keys known in advance.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	if key, ok := k.Keys[id]; ok {
+		return key, nil
+	}
+	return nil, &UnknownKeyError{ID: id}
+}
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("unknown encryption key %q", e.ID)
+}
+
+func (e *UnknownKeyError) Unwrap() error {
+	return ErrUnknownKey
+}
+
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (sv *storedValue) nullKeyID() any {
+	if sv.keyid == "" {
+		return nil
+	}
+	return sv.keyid
+}
+
+func (c *PermanentCache) aead(key []byte) (cipher.AEAD, error) {
+	if c.NewAEAD != nil {
+		return c.NewAEAD(key)
+	}
+	return NewAESGCM(key)
+}
+
+// sealAAD authenticates the kind and the checksum, so neither the kind
+// nor the ciphertexts of two rows can be swapped.
+func sealAAD(kind string, sum []byte) []byte {
+	aad := make([]byte, 0, len(kind)+1+len(sum))
+	aad = append(aad, kind...)
+	aad = append(aad, 0)
+	return append(aad, sum...)
+}
+
+// seal encrypts the compressed value: nonce | ciphertext.
+func (c *PermanentCache) seal(sv *storedValue) error {
+	if c.KeyProvider == nil {
+		return nil
+	}
+	id, key, err := c.KeyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := c.aead(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(sv.value)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	sv.value = aead.Seal(nonce, nonce, sv.value, sealAAD(sv.kind, sv.checksum))
+	sv.keyid = id
+	return nil
+}
+
+func (c *PermanentCache) unseal(key string, kind string, keyid string, value []byte, sum []byte) ([]byte, error) {
+	if keyid == "" {
+		return value, nil
+	}
+	if c.KeyProvider == nil {
+		return nil, &UnknownKeyError{ID: keyid}
+	}
+	secret, err := c.KeyProvider.Key(keyid)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) < aead.NonceSize() {
+		return nil, &CorruptionError{Key: key, Reason: "encrypted value is too short"}
+	}
+	nonce, sealed := value[:aead.NonceSize()], value[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, sealAAD(kind, sum))
+	if err != nil {
+		return nil, &CorruptionError{Key: key, Reason: "decryption failed", Err: err}
+	}
+	return plain, nil
+}
+
+// ReEncrypt rewrites rows not encrypted with the current key, including
+// plain legacy rows, which get keyed checksums. Returns the number of rewritten rows.
+func (c *PermanentCache) ReEncrypt(ctx context.Context) (int, error) {
+	if c.KeyProvider == nil {
+		return 0, errors.New("no key provider")
+	}
+	current, _, err := c.KeyProvider.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.rewriteRows(ctx, func(r *rawRow) (*storedValue, error) {
+		if r.keyid == current {
+			return nil, nil
+		}
+		value, err := c.unseal(r.key, r.kind, r.keyid, r.value, r.checksum)
+		if err != nil {
+			return nil, err
+		}
+		sv := storedValue{kind: r.kind, value: value, checksum: r.checksum}
+		if r.keyid == "" {
+			// plain rows have an unkeyed checksum
+			data, err := c.decode(r.kind, value)
+			if err != nil {
+				return nil, &CorruptionError{Key: r.key, Reason: "decode failed", Err: err}
+			}
+			sv.checksum = c.checksum(data, true)
+		}
+		if err = c.seal(&sv); err != nil {
+			return nil, err
+		}
+		return &sv, nil
+	})
+}
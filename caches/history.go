@@ -0,0 +1,139 @@
+package caches
+
+import (
+	"database/sql"
+	"time"
+)
+
+// History keeps values replaced by Put, numbered from 1 per key.
+// It outlives Remove and expiry until pruned.
+
+type Version struct {
+	Version int
+	// Created is when the value was put, Archived when it was replaced.
+	Created  time.Time
+	Archived time.Time
+	Comment  string
+	Kind     string
+}
+
+// archive copies the current row of key to history, expects the write lock.
+func (c *PermanentCache) archive(db execer, key string) error {
+	if _, err := db.Exec(`INSERT INTO history(key, version, created, comment, kind, keyid, value, checksum, blob)
+		SELECT key, COALESCE((SELECT MAX(version) FROM history WHERE key=?), 0) + 1, created, comment, kind, keyid, value, checksum, blob
+		FROM cache WHERE key=?`, key, key); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM history WHERE key=? AND version <= (SELECT MAX(version) FROM history WHERE key=?) - ?`,
+		key, key, c.HistoryDepth)
+	return err
+}
+
+// ListVersions returns previous values of key, oldest first.
+func (c *PermanentCache) ListVersions(key string) ([]Version, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	rows, err := c.DB.Query(`SELECT version, CAST(created AS TEXT), CAST(archived AS TEXT), comment, kind
+		FROM history WHERE key=? ORDER BY version`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]Version, 0)
+	for rows.Next() {
+		var v Version
+		var created, archived string
+		if err = rows.Scan(&v.Version, &created, &archived, &v.Comment, &v.Kind); err != nil {
+			return nil, err
+		}
+		if v.Created, err = time.Parse(sqliteTime, created); err != nil {
+			return nil, err
+		}
+		if v.Archived, err = time.Parse(sqliteTime, archived); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// GetVersion returns ErrNotFound for unknown versions.
+func (c *PermanentCache) GetVersion(key string, version int) ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, data, err := c.readVersion(key, version)
+	return data, err
+}
+
+func (c *PermanentCache) readVersion(key string, version int) (*Version, []byte, error) {
+	v := Version{Version: version}
+	var keyid string
+	var value, sum []byte
+	err := c.DB.QueryRow(`SELECT h.comment,
+			CASE WHEN h.blob IS NULL THEN h.kind ELSE b.kind END,
+			COALESCE(CASE WHEN h.blob IS NULL THEN h.keyid ELSE b.keyid END, ''),
+			CASE WHEN h.blob IS NULL THEN h.value ELSE b.value END,
+			h.checksum
+		FROM history h LEFT JOIN blobs b ON b.hash=h.blob
+		WHERE h.key=? AND h.version=?`, key, version).Scan(&v.Comment, &v.Kind, &keyid, &value, &sum)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := c.decodeRow(key, v.Kind, keyid, value, sum, c.VerifyOnGet)
+	return &v, data, err
+}
+
+// Rollback makes a previous version current again. The replaced value
+// goes to history like with Put, the entry gets DefaultTTL.
+func (c *PermanentCache) Rollback(key string, version int) error {
+	c.lock.RLock()
+	v, data, err := c.readVersion(key, version)
+	c.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return c.Put(key, v.Comment, data, v.Kind)
+}
+
+// PruneHistory keeps at most keep versions per key and deletes versions
+// archived more than maxAge ago. Zero disables the respective limit.
+func (c *PermanentCache) PruneHistory(keep int, maxAge time.Duration) (int64, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var total int64
+	err := c.writeTx(func(tx *sql.Tx) error {
+		total = 0
+		if keep > 0 {
+			res, err := tx.Exec(`DELETE FROM history WHERE version <= (SELECT MAX(version) FROM history h WHERE h.key=history.key) - ?`, keep)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			total += n
+		}
+		if maxAge > 0 {
+			res, err := tx.Exec(`DELETE FROM history WHERE archived < ?`, time.Now().Add(-maxAge).UTC().Format(sqliteTime))
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			total += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
@@ -0,0 +1,207 @@
+package caches
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Tags and attributes survive Put of the same key
+// and are deleted together with the entry.
+
+var ErrNotFound = errors.New("key not found")
+
+func attrPath(name string) string {
+	return "$." + strconv.Quote(name)
+}
+
+// exists expects a lock to be held.
+func (c *PermanentCache) exists(db execer, key string) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM cache WHERE key=?", key).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetComment updates the comment without rewriting the value.
+func (c *PermanentCache) SetComment(key string, comment string) error {
+	return c.updateRow(key, "UPDATE cache SET comment=? WHERE key=?", comment)
+}
+
+// SetTags replaces tags of the key.
+func (c *PermanentCache) SetTags(key string, tags ...string) error {
+	return c.changeTags(key, true, tags)
+}
+
+func (c *PermanentCache) AddTags(key string, tags ...string) error {
+	return c.changeTags(key, false, tags)
+}
+
+func (c *PermanentCache) changeTags(key string, replace bool, tags []string) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.writeTx(func(tx *sql.Tx) error { return c.writeTags(tx, key, replace, tags) })
+}
+
+func (c *PermanentCache) writeTags(db execer, key string, replace bool, tags []string) error {
+	if err := c.exists(db, key); err != nil {
+		return err
+	}
+	if replace {
+		if _, err := db.Exec("DELETE FROM tags WHERE key=?", key); err != nil {
+			return err
+		}
+	}
+	for _, tag := range tags {
+		if _, err := db.Exec("INSERT OR IGNORE INTO tags(key, tag) VALUES(?,?)", key, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *PermanentCache) RemoveTags(key string, tags ...string) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.writeTx(func(tx *sql.Tx) error {
+		for _, tag := range tags {
+			if _, err := tx.Exec("DELETE FROM tags WHERE key=? AND tag=?", key, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *PermanentCache) Tags(key string) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	rows, err := c.DB.Query("SELECT tag FROM tags WHERE key=? ORDER BY tag", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// RemoveByTag deletes all entries with the tag.
+func (c *PermanentCache) RemoveByTag(tag string) (int64, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var keys []string
+	err := c.retryBusy(func() (err error) {
+		keys, err = deleteReturning(c.DB, "DELETE FROM cache WHERE key IN (SELECT key FROM tags WHERE tag=?) RETURNING key", tag)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.notify(EventRemove, keys...)
+	return int64(len(keys)), nil
+}
+
+// SetAttrs replaces attributes of the key, nil removes them.
+func (c *PermanentCache) SetAttrs(key string, attrs map[string]any) error {
+	js, err := attrsJSON(attrs)
+	if err != nil {
+		return err
+	}
+	return c.updateRow(key, setAttrsQuery, js)
+}
+
+const setAttrsQuery = "UPDATE cache SET attrs=? WHERE key=?"
+
+// attrsJSON returns nil for nil attrs, which is stored as NULL
+func attrsJSON(attrs map[string]any) (any, error) {
+	if attrs == nil {
+		return nil, nil
+	}
+	buf, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return string(buf), nil
+}
+
+// UpdateAttrs merges attrs into existing attributes, nil values delete them.
+func (c *PermanentCache) UpdateAttrs(key string, attrs map[string]any) error {
+	buf, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return c.updateRow(key, "UPDATE cache SET attrs=json_patch(COALESCE(attrs, '{}'), ?) WHERE key=?", string(buf))
+}
+
+// updateRow runs query with value and key, ErrNotFound if no row has changed.
+func (c *PermanentCache) updateRow(key string, query string, value any) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.retryBusy(func() error { return updateExec(c.DB, key, query, value) })
+}
+
+func updateExec(db execer, key string, query string, value any) error {
+	res, err := db.Exec(query, value, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Attrs returns nil if the key has no attributes.
+func (c *PermanentCache) Attrs(key string) (map[string]any, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var js *string
+	err := c.DB.QueryRow("SELECT attrs FROM cache WHERE key=?", key).Scan(&js)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if js == nil {
+		return nil, nil
+	}
+	var attrs map[string]any
+	err = json.Unmarshal([]byte(*js), &attrs)
+	return attrs, err
+}
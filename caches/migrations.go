@@ -0,0 +1,307 @@
+package caches
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrSchemaTooNew = errors.New("cache schema is newer than supported")
+
+// SchemaError is returned by Open for databases written by a newer version.
+type SchemaError struct {
+	Path      string
+	Version   int
+	Supported int
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s: schema version %d, supported up to %d", e.Path, e.Version, e.Supported)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return ErrSchemaTooNew
+}
+
+// migrations[i] upgrades the schema from version i to i+1.
+// Files created before versioning have user_version 0 and may already
+// contain some of the columns, so migrations must be idempotent.
+// Append only, never change a released migration.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: initial table
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS cache (
+				key     VARCHAR (255) NOT NULL PRIMARY KEY,
+				created DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				comment VARCHAR (255) NOT NULL,
+				kind    VARCHAR (32) NOT NULL,
+				value   BLOB
+			);`)
+		return err
+	},
+	// 2: ttl
+	func(tx *sql.Tx) error {
+		_, err := addColumn(tx, "cache", "expires", "INTEGER")
+		return err
+	},
+	// 3: lru
+	func(tx *sql.Tx) error {
+		if added, err := addColumn(tx, "cache", "accessed", "INTEGER"); err != nil {
+			return err
+		} else if added {
+			if _, err = tx.Exec("UPDATE cache SET accessed=CAST(strftime('%s', created) AS INTEGER)*1000;"); err != nil {
+				return err
+			}
+		}
+		if added, err := addColumn(tx, "cache", "size", "INTEGER"); err != nil {
+			return err
+		} else if added {
+			if _, err = tx.Exec("UPDATE cache SET size=COALESCE(LENGTH(value), 0);"); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS cache_accessed ON cache(accessed, size);")
+		return err
+	},
+	// 4: zstd dictionaries
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS dicts (
+				id      INTEGER NOT NULL PRIMARY KEY,
+				created DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				dict    BLOB NOT NULL
+			);`)
+		return err
+	},
+	// 5: checksums, legacy rows have none
+	func(tx *sql.Tx) error {
+		if _, err := addColumn(tx, "cache", "checksum", "BLOB"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS quarantine (
+				key     VARCHAR (255) NOT NULL,
+				created DATETIME NOT NULL,
+				comment VARCHAR (255) NOT NULL,
+				kind    VARCHAR (32) NOT NULL,
+				value   BLOB,
+				checksum BLOB,
+				reason  TEXT NOT NULL,
+				moved   DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+			);`)
+		return err
+	},
+	// 6: encryption key id, NULL for plain values
+	func(tx *sql.Tx) error {
+		if _, err := addColumn(tx, "cache", "keyid", "VARCHAR (64)"); err != nil {
+			return err
+		}
+		_, err := addColumn(tx, "quarantine", "keyid", "VARCHAR (64)")
+		return err
+	},
+	// 7: deduplicated values, refs are maintained by triggers
+	func(tx *sql.Tx) error {
+		if _, err := addColumn(tx, "cache", "blob", "BLOB"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS blobs (
+				hash    BLOB NOT NULL PRIMARY KEY,
+				refs    INTEGER NOT NULL,
+				kind    VARCHAR (32) NOT NULL,
+				keyid   VARCHAR (64),
+				value   BLOB NOT NULL,
+				size    INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS cache_blob ON cache(blob) WHERE blob IS NOT NULL;
+
+			CREATE TRIGGER IF NOT EXISTS blob_ref_insert AFTER INSERT ON cache WHEN NEW.blob IS NOT NULL
+			BEGIN
+				UPDATE blobs SET refs=refs+1 WHERE hash=NEW.blob;
+			END;
+			CREATE TRIGGER IF NOT EXISTS blob_ref_delete AFTER DELETE ON cache WHEN OLD.blob IS NOT NULL
+			BEGIN
+				UPDATE blobs SET refs=refs-1 WHERE hash=OLD.blob;
+				DELETE FROM blobs WHERE hash=OLD.blob AND refs<=0;
+			END;
+			CREATE TRIGGER IF NOT EXISTS blob_ref_update AFTER UPDATE OF blob ON cache WHEN OLD.blob IS NOT NEW.blob
+			BEGIN
+				UPDATE blobs SET refs=refs+1 WHERE hash=NEW.blob;
+				UPDATE blobs SET refs=refs-1 WHERE hash=OLD.blob;
+				DELETE FROM blobs WHERE hash=OLD.blob AND refs<=0;
+			END;
+
+			CREATE VIEW IF NOT EXISTS entries AS
+			SELECT c.rowid AS id, c.key, c.created, c.comment, c.expires, c.accessed, c.checksum, c.blob,
+				CASE WHEN c.blob IS NULL THEN c.kind ELSE b.kind END AS kind,
+				CASE WHEN c.blob IS NULL THEN c.keyid ELSE b.keyid END AS keyid,
+				CASE WHEN c.blob IS NULL THEN c.value ELSE b.value END AS value
+			FROM cache c LEFT JOIN blobs b ON b.hash=c.blob;`)
+		return err
+	},
+	// 8: tags and json attributes
+	func(tx *sql.Tx) error {
+		if _, err := addColumn(tx, "cache", "attrs", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS tags (
+				key     VARCHAR (255) NOT NULL,
+				tag     VARCHAR (255) NOT NULL,
+				PRIMARY KEY (key, tag)
+			) WITHOUT ROWID;
+			CREATE INDEX IF NOT EXISTS tags_tag ON tags(tag);
+
+			CREATE TRIGGER IF NOT EXISTS tags_delete AFTER DELETE ON cache
+			BEGIN
+				DELETE FROM tags WHERE key=OLD.key;
+			END;`)
+		return err
+	},
+	// 9: version history, deduplicated values are referenced by history too
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS history (
+				key     VARCHAR (255) NOT NULL,
+				version INTEGER NOT NULL,
+				created DATETIME NOT NULL,
+				archived DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				comment VARCHAR (255) NOT NULL,
+				kind    VARCHAR (32) NOT NULL,
+				keyid   VARCHAR (64),
+				value   BLOB,
+				checksum BLOB,
+				blob    BLOB,
+				PRIMARY KEY (key, version)
+			);
+
+			CREATE TRIGGER IF NOT EXISTS history_ref_insert AFTER INSERT ON history WHEN NEW.blob IS NOT NULL
+			BEGIN
+				UPDATE blobs SET refs=refs+1 WHERE hash=NEW.blob;
+			END;
+			CREATE TRIGGER IF NOT EXISTS history_ref_delete AFTER DELETE ON history WHEN OLD.blob IS NOT NULL
+			BEGIN
+				UPDATE blobs SET refs=refs-1 WHERE hash=OLD.blob;
+				DELETE FROM blobs WHERE hash=OLD.blob AND refs<=0;
+			END;`)
+		return err
+	},
+	// 10: history follows blobs rehashed by ReEncrypt
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TRIGGER IF NOT EXISTS history_ref_update AFTER UPDATE OF blob ON history WHEN OLD.blob IS NOT NEW.blob
+			BEGIN
+				UPDATE blobs SET refs=refs+1 WHERE hash=NEW.blob;
+				UPDATE blobs SET refs=refs-1 WHERE hash=OLD.blob;
+				DELETE FROM blobs WHERE hash=OLD.blob AND refs<=0;
+			END;`)
+		return err
+	},
+	// 11: expired rows are found without a scan
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS cache_expires ON cache(expires) WHERE expires IS NOT NULL;")
+		return err
+	},
+	// 12: running totals checked by evict, maintained by triggers
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS cache_stats (
+				id      INTEGER NOT NULL PRIMARY KEY CHECK (id = 0),
+				keys    INTEGER NOT NULL,
+				size    INTEGER NOT NULL
+			);
+			INSERT OR REPLACE INTO cache_stats(id, keys, size) SELECT 0, COUNT(*), COALESCE(SUM(size), 0) FROM cache;
+
+			CREATE TRIGGER IF NOT EXISTS stats_insert AFTER INSERT ON cache
+			BEGIN
+				UPDATE cache_stats SET keys=keys+1, size=size+COALESCE(NEW.size, 0);
+			END;
+			CREATE TRIGGER IF NOT EXISTS stats_delete AFTER DELETE ON cache
+			BEGIN
+				UPDATE cache_stats SET keys=keys-1, size=size-COALESCE(OLD.size, 0);
+			END;
+			CREATE TRIGGER IF NOT EXISTS stats_update AFTER UPDATE OF size ON cache
+			BEGIN
+				UPDATE cache_stats SET size=size+COALESCE(NEW.size, 0)-COALESCE(OLD.size, 0);
+			END;`)
+		return err
+	},
+}
+
+// SchemaVersion is the version of newly created or upgraded cache files.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func (c *PermanentCache) migrate() error {
+	var version int
+	if err := c.DB.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return &SchemaError{Path: c.dbpath, Version: version, Supported: len(migrations)}
+	}
+
+	if c.ReadOnly {
+		if version < len(migrations) {
+			return fmt.Errorf("%s: schema version %d needs upgrade to %d: %w", c.dbpath, version, len(migrations), ErrReadOnly)
+		}
+		return nil
+	}
+
+	// files created before versioning have the table but user_version 0
+	from, legacy := version, false
+	if version == 0 {
+		if err := c.DB.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name='cache'").Scan(&legacy); err != nil {
+			return err
+		}
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := c.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if err = migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: migration to version %d: %w", c.dbpath, version+1, err)
+		}
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version=%d;", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if (from > 0 || legacy) && from < version {
+		log.Printf("DB: %s schema upgraded from version %d to %d", c.dbpath, from, version)
+	}
+	return nil
+}
+
+// addColumn returns false if the table already has the column.
+func addColumn(tx *sql.Tx, table string, name string, decl string) (bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col string
+		if err = rows.Scan(&col); err != nil {
+			return false, err
+		}
+		if col == name {
+			return false, nil
+		}
+	}
+	rows.Close()
+
+	if _, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + decl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
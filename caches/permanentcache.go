@@ -1,12 +1,15 @@
 package caches
 
 import (
+	"crypto/cipher"
 	"database/sql"
-	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	// driver
 	"github.com/radozd/goutils/files"
@@ -17,41 +20,133 @@ type PermanentCache struct {
 	*sql.DB
 	dbpath string
 	lock   sync.RWMutex
+
+	// DefaultTTL is applied by Put. Zero means entries never expire.
+	DefaultTTL time.Duration
+	// VacuumAfter: the sweeper vacuums the database once expired rows
+	// of at least this many bytes have been deleted. Zero disables it.
+	VacuumAfter int64
+
+	// Level is the compression level for codecs implementing LevelCodec.
+	// Zero means the codec default.
+	Level int
+
+	// UseDict: Put stores "zstd" values as KindZstdDict once a dictionary is trained.
+	UseDict bool
+
+	// ComputeCompress is the compression of values stored by GetOrCompute.
+	ComputeCompress string
+	// NegativeTTL: GetOrCompute remembers loader errors for this time. Zero disables it.
+	NegativeTTL time.Duration
+
+	// VerifyOnGet checks the checksum of every value read by Get.
+	VerifyOnGet bool
+
+	// KeyProvider enables encryption of new values, plain rows stay readable.
+	KeyProvider KeyProvider
+	// ChecksumKey is required with KeyProvider. It keys the checksums of encrypted
+	// values, which are also their dedup hashes, and must survive key rotation.
+	ChecksumKey []byte
+	// NewAEAD creates the cipher for a key, AES-GCM if nil.
+	// chacha20poly1305.NewX from golang.org/x/crypto fits as well.
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+
+	// Dedup stores identical payloads once, keys reference them by checksum.
+	// Both kinds of rows can be mixed in one database.
+	Dedup bool
+
+	// HistoryDepth is the number of previous values kept by Put. Zero disables history.
+	HistoryDepth int
+
+	// MaxBytes and MaxRows bound the cache size, least recently used
+	// entries are evicted by Put. Zero means no limit.
+	MaxBytes int64
+	MaxRows  int64
+	// EvictBatch is the number of rows examined per eviction step.
+	EvictBatch int
+
+	// ReadOnly opens the file without write access, so it can be inspected
+	// while another process writes. Writes return ErrReadOnly.
+	ReadOnly bool
+	// BusyTimeout is how long sqlite waits for a lock held by another connection.
+	BusyTimeout time.Duration
+	// BusyRetries: writes failing with SQLITE_BUSY are repeated with backoff,
+	// then BusyError is returned.
+	BusyRetries int
+	// MaxConns limits the connection pool. Zero means no limit.
+	MaxConns int
+
+	dict atomic.Pointer[zstdDictCodec]
+
+	sweeper chan struct{}
+	freed   int64
+
+	touchLock sync.Mutex
+	touched   map[string]int64
+
+	watchLock sync.Mutex
+	watchers  map[*watcher]struct{}
+
+	flightLock sync.Mutex
+	calls      map[string]*computeCall
+	failed     map[string]failedCall
+	// failed is pruned when it grows to pruneAt entries
+	pruneAt int
 }
 
 func NewPermanentCache(fname string) *PermanentCache {
 	return &PermanentCache{
-		dbpath: fname,
+		dbpath:      fname,
+		BusyTimeout: defaultBusyTimeout,
+		BusyRetries: 3,
 	}
 }
 
 func (c *PermanentCache) Open() error {
-	log.Println("DB: using " + c.dbpath)
+	if c.KeyProvider != nil && len(c.ChecksumKey) == 0 {
+		return fmt.Errorf("%s: KeyProvider requires ChecksumKey", c.dbpath)
+	}
 
 	create := !files.Exists(c.dbpath)
+	if c.ReadOnly {
+		if create {
+			return fmt.Errorf("%s: %w", c.dbpath, os.ErrNotExist)
+		}
+		log.Println("DB: using " + c.dbpath + " read-only")
+	} else {
+		log.Println("DB: using " + c.dbpath)
+	}
+
 	var err error
-	if c.DB, err = sql.Open("sqlite", c.dbpath); err != nil {
+	if c.DB, err = sql.Open("sqlite", c.dsn()); err != nil {
 		return err
 	}
+	if c.MaxConns > 0 {
+		c.DB.SetMaxOpenConns(c.MaxConns)
+		c.DB.SetMaxIdleConns(c.MaxConns)
+	}
 
 	if create {
 		c.DB.Exec("PRAGMA journal_mode=WAL;")
+	}
 
-		if _, err := c.Exec(
-			`CREATE TABLE IF NOT EXISTS cache (
-				key     VARCHAR (255) NOT NULL PRIMARY KEY,
-				created DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
-				comment VARCHAR (255) NOT NULL,
-				kind    VARCHAR (32) NOT NULL,
-				value   BLOB
-			);`); err != nil {
-			return err
-		}
+	if err = c.migrate(); err == nil {
+		err = c.loadDicts()
+	}
+	if err != nil {
+		c.DB.Close()
+		return err
 	}
 	return nil
 }
 
 func (c *PermanentCache) Close() {
+	c.StopSweeper()
+	if c.ReadOnly {
+		c.DB.Close()
+		return
+	}
+	c.flushTouched()
 	c.DB.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
 	c.DB.Close()
 }
@@ -65,7 +160,7 @@ func (c *PermanentCache) Contains(key string) (bool, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	rows, err := c.DB.Query("SELECT kind, value FROM cache WHERE key=? AND value IS NOT NULL", key)
+	rows, err := c.DB.Query("SELECT key FROM entries WHERE key=? AND value IS NOT NULL AND "+notExpired, key, nowMs())
 	if err != nil {
 		return false, err
 	}
@@ -76,10 +171,26 @@ func (c *PermanentCache) Contains(key string) (bool, error) {
 }
 
 func (c *PermanentCache) Remove(key string) (bool, error) {
+	if err := c.writable(); err != nil {
+		return false, err
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	res, err := c.DB.Exec("DELETE FROM cache WHERE key=?", key)
+	var removed bool
+	err := c.retryBusy(func() (err error) {
+		removed, err = c.deleteRow(c.DB, key)
+		return err
+	})
+	if removed && err == nil {
+		c.notify(EventRemove, key)
+	}
+	return removed, err
+}
+
+func (c *PermanentCache) deleteRow(db execer, key string) (bool, error) {
+	res, err := db.Exec("DELETE FROM cache WHERE key=?", key)
 	if err != nil {
 		return false, err
 	}
@@ -90,61 +201,186 @@ func (c *PermanentCache) Remove(key string) (bool, error) {
 	return rows > 0, nil
 }
 
-// Put: insert or overwrite key
+// Put: insert or overwrite key. The entry expires after DefaultTTL, if set.
 func (c *PermanentCache) Put(key string, comment string, data []byte, compress string) error {
+	return c.PutTTL(key, comment, data, compress, c.DefaultTTL)
+}
+
+// PutTTL: insert or overwrite key, the entry expires after ttl. Zero ttl means never.
+func (c *PermanentCache) PutTTL(key string, comment string, data []byte, compress string, ttl time.Duration) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	sv, err := c.prepareValue(compress, data)
+	if err != nil {
+		return err
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	var err error
-	var value []byte
-	switch compress {
-	case "zlib":
-		if value, err = ZlibPack(data); err != nil {
+	if err = c.writeTx(func(tx *sql.Tx) error { return c.insertRow(tx, key, comment, sv, ttl) }); err != nil {
+		return err
+	}
+	c.notify(EventPut, key)
+	c.evictAfterWrite()
+	return nil
+}
+
+// storedValue is a value ready to be written to the cache table.
+type storedValue struct {
+	kind     string
+	value    []byte
+	checksum []byte
+	keyid    string
+}
+
+// prepareValue compresses data, it does not need the lock.
+func (c *PermanentCache) prepareValue(compress string, data []byte) (storedValue, error) {
+	if compress == "zstd" && c.UseDict && c.dict.Load() != nil {
+		compress = KindZstdDict
+	}
+	value, err := c.encode(compress, data)
+	if err != nil {
+		return storedValue{}, err
+	}
+	sv := storedValue{kind: compress, value: value, checksum: c.checksum(data, c.KeyProvider != nil)}
+	err = c.seal(&sv)
+	return sv, err
+}
+
+func (c *PermanentCache) insertRow(db execer, key string, comment string, sv storedValue, ttl time.Duration) error {
+	var expires any
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixMilli()
+	}
+
+	value, keyid, blob := sv.value, sv.nullKeyID(), any(nil)
+	if c.Dedup {
+		if _, err := db.Exec("INSERT INTO blobs(hash, refs, kind, keyid, value, size) VALUES(?,0,?,?,?,?) ON CONFLICT(hash) DO NOTHING",
+			sv.checksum, sv.kind, keyid, sv.value, len(sv.value)); err != nil {
 			return err
 		}
-	case "zstd":
-		if value, err = ZstdPack(data); err != nil {
+		value, keyid, blob = nil, nil, sv.checksum
+	}
+
+	if c.HistoryDepth > 0 {
+		if err := c.archive(db, key); err != nil {
 			return err
 		}
-	case "":
-		value = data
-	default:
-		panic("unknown compression type")
 	}
 
-	_, err = c.DB.Exec("INSERT OR REPLACE INTO cache(key, comment, kind, value) VALUES(?,?,?,?)",
-		key, comment, compress, value)
+	// upsert instead of replace, so that triggers see the old blob
+	_, err := db.Exec(`INSERT INTO cache(key, comment, kind, value, expires, accessed, size, checksum, keyid, blob) VALUES(?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(key) DO UPDATE SET created=CURRENT_TIMESTAMP, comment=excluded.comment, kind=excluded.kind, value=excluded.value,
+			expires=excluded.expires, accessed=excluded.accessed, size=excluded.size, checksum=excluded.checksum,
+			keyid=excluded.keyid, blob=excluded.blob`,
+		key, comment, sv.kind, value, expires, nowMs(), len(sv.value), sv.checksum, keyid, blob)
 	return err
 }
 
+// Get returns nil for missing keys, use Lookup to tell them from empty values.
 func (c *PermanentCache) Get(key string) ([]byte, error) {
+	data, _, err := c.Lookup(key)
+	return data, err
+}
+
+func (c *PermanentCache) Lookup(key string) ([]byte, bool, error) {
+	data, _, found, err := c.lookupExpiring(key)
+	return data, found, err
+}
+
+// lookupExpiring also returns the expiry time, zero for entries without TTL.
+func (c *PermanentCache) lookupExpiring(key string) ([]byte, time.Time, bool, error) {
 	c.lock.RLock()
-	defer c.lock.RUnlock()
+	data, expires, found, err := c.readExpiring(c.DB, key)
+	c.lock.RUnlock()
+
+	if found {
+		c.touch(key)
+	}
+	return data, expires, found, err
+}
 
-	rows, err := c.DB.Query("SELECT kind, value FROM cache WHERE key=?", key)
+func (c *PermanentCache) readRow(db execer, key string) ([]byte, bool, error) {
+	data, _, found, err := c.readExpiring(db, key)
+	return data, found, err
+}
+
+func (c *PermanentCache) readExpiring(db execer, key string) ([]byte, time.Time, bool, error) {
+	var expires time.Time
+	rows, err := db.Query("SELECT kind, COALESCE(keyid, ''), value, checksum, expires FROM entries WHERE key=? AND "+notExpired, key, nowMs())
 	if err != nil {
-		return nil, err
+		return nil, expires, false, err
 	}
 	defer rows.Close()
 
 	if rows.Next() {
-		var kind string
-		var value []byte
-		if err = rows.Scan(&kind, &value); err != nil {
-			return nil, err
+		var kind, keyid string
+		var value, sum []byte
+		var ms sql.NullInt64
+		if err = rows.Scan(&kind, &keyid, &value, &sum, &ms); err != nil {
+			return nil, expires, false, err
 		}
-		switch kind {
-		case "zlib":
-			return ZlibUnpack(value)
-		case "zstd":
-			return ZstdUnpack(value)
-		case "":
-			return value, nil
-		default:
-			return nil, errors.New("unknown compression type")
+		if ms.Valid {
+			expires = time.UnixMilli(ms.Int64)
 		}
+		data, err := c.decodeRow(key, kind, keyid, value, sum, c.VerifyOnGet)
+		return data, expires, true, err
 	}
-	return nil, nil
+	return nil, expires, false, nil
+}
+
+// RawEntry is a stored value still encoded with the Kind codec.
+type RawEntry struct {
+	Entry
+	// Checksum of the decoded value, nil for rows written before checksums.
+	Checksum []byte
+	// Expires is zero for entries without TTL.
+	Expires time.Time
+}
+
+// Raw returns the stored value without decoding it, encrypted values are decrypted.
+func (c *PermanentCache) Raw(key string) (RawEntry, bool, error) {
+	e, found, err := c.raw(key)
+	if found {
+		c.touch(key)
+	}
+	return e, found, err
+}
+
+func (c *PermanentCache) raw(key string) (RawEntry, bool, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var e RawEntry
+	rows, err := c.DB.Query(`SELECT comment, kind, CAST(created AS TEXT), expires, COALESCE(keyid, ''), value, checksum
+		FROM entries WHERE key=? AND `+notExpired, key, nowMs())
+	if err != nil {
+		return e, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return e, false, rows.Err()
+	}
+	var created, keyid string
+	var expires sql.NullInt64
+	if err = rows.Scan(&e.Comment, &e.Kind, &created, &expires, &keyid, &e.Value, &e.Checksum); err != nil {
+		return e, false, err
+	}
+	e.Key = key
+	e.Created, _ = time.ParseInLocation(sqliteTime, created, time.UTC)
+	if expires.Valid {
+		e.Expires = time.UnixMilli(expires.Int64)
+	}
+	e.Value, err = c.unseal(key, e.Kind, keyid, e.Value, e.Checksum)
+	return e, true, err
+}
+
+// Decode decompresses a value returned by Raw.
+func (c *PermanentCache) Decode(kind string, value []byte) ([]byte, error) {
+	return c.decode(kind, value)
 }
 
 func (c *PermanentCache) GetComment(key string) (string, error) {
@@ -152,7 +388,7 @@ func (c *PermanentCache) GetComment(key string) (string, error) {
 	defer c.lock.RUnlock()
 
 	var comment string
-	rows, err := c.DB.Query("SELECT comment FROM cache WHERE key=?", key)
+	rows, err := c.DB.Query("SELECT comment FROM cache WHERE key=? AND "+notExpired, key, nowMs())
 	if err != nil {
 		return "", err
 	}
@@ -183,7 +419,7 @@ func (c *PermanentCache) ListKeys() ([]string, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	rows, err := c.DB.Query("SELECT key FROM cache")
+	rows, err := c.DB.Query("SELECT key FROM cache WHERE "+notExpired, nowMs())
 	if err != nil {
 		return nil, err
 	}
@@ -205,26 +441,17 @@ func (c *PermanentCache) MemCache() (map[string][]byte, error) {
 	defer c.lock.RUnlock()
 
 	cache := make(map[string][]byte)
-	rows, err := c.DB.Query("SELECT key, kind, value FROM cache")
+	rows, err := c.DB.Query("SELECT key, kind, COALESCE(keyid, ''), value, checksum FROM entries WHERE "+notExpired, nowMs())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var key, kind string
-		var value []byte
-		if err = rows.Scan(&key, &kind, &value); err == nil {
-			switch kind {
-			case "zlib":
-				cache[key], err = ZlibUnpack(value)
-			case "zstd":
-				cache[key], err = ZstdUnpack(value)
-			case "":
-				cache[key] = value
-			default:
-				err = errors.New("unknown compression type")
-			}
+		var key, kind, keyid string
+		var value, sum []byte
+		if err = rows.Scan(&key, &kind, &keyid, &value, &sum); err == nil {
+			cache[key], err = c.decodeRow(key, kind, keyid, value, sum, c.VerifyOnGet)
 		}
 		if err != nil {
 			return nil, err
@@ -0,0 +1,159 @@
+package caches
+
+import (
+	"database/sql"
+	"log"
+)
+
+// access times are collected in memory and written in bulk
+const touchFlushSize = 1024
+
+func (c *PermanentCache) touch(key string) {
+	if (c.MaxBytes <= 0 && c.MaxRows <= 0) || c.ReadOnly {
+		return
+	}
+
+	c.touchLock.Lock()
+	if c.touched == nil {
+		c.touched = make(map[string]int64)
+	}
+	c.touched[key] = nowMs()
+	flush := len(c.touched) >= touchFlushSize
+	c.touchLock.Unlock()
+
+	if flush {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if err := c.writeTouched(); err != nil {
+			log.Println("DB: access time update failed:", err)
+		}
+	}
+}
+
+func (c *PermanentCache) flushTouched() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.writeTouched(); err != nil {
+		log.Println("DB: access time update failed:", err)
+	}
+}
+
+// writeTouched expects the write lock to be held.
+func (c *PermanentCache) writeTouched() error {
+	c.touchLock.Lock()
+	touched := c.touched
+	c.touched = nil
+	c.touchLock.Unlock()
+
+	if len(touched) == 0 {
+		return nil
+	}
+
+	return c.writeTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("UPDATE cache SET accessed=? WHERE key=?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for key, tm := range touched {
+			if _, err = stmt.Exec(tm, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// evictAfterWrite only logs failures, the write is committed already
+// and must not be reported as failed.
+// It expects the write lock to be held.
+func (c *PermanentCache) evictAfterWrite() {
+	if err := c.evict(); err != nil {
+		log.Println("DB: eviction failed:", err)
+	}
+}
+
+// triggers keep the totals, counting rows would scan the table
+const statsQuery = "SELECT keys, size FROM cache_stats"
+
+// evict expects the write lock to be held.
+func (c *PermanentCache) evict() error {
+	if c.MaxBytes <= 0 && c.MaxRows <= 0 {
+		return nil
+	}
+	if err := c.writeTouched(); err != nil {
+		return err
+	}
+
+	var count, total int64
+	if err := c.DB.QueryRow(statsQuery).Scan(&count, &total); err != nil {
+		return err
+	}
+	if !c.overBudget(count, total) {
+		return nil
+	}
+
+	batch := c.EvictBatch
+	if batch <= 0 {
+		batch = 100
+	}
+
+	var expired, evicted []string
+	err := c.writeTx(func(tx *sql.Tx) (err error) {
+		evicted = nil
+		// expired entries go first
+		expired, err = deleteReturning(tx, "DELETE FROM cache WHERE expires <= ? RETURNING key", nowMs())
+		if err != nil {
+			return err
+		}
+		if err = tx.QueryRow(statsQuery).Scan(&count, &total); err != nil {
+			return err
+		}
+
+		for c.overBudget(count, total) {
+			rows, err := tx.Query("SELECT key, size FROM cache ORDER BY accessed LIMIT ?", batch)
+			if err != nil {
+				return err
+			}
+
+			keys := make([]any, 0, batch)
+			names := make([]string, 0, batch)
+			for rows.Next() && c.overBudget(count, total) {
+				var key string
+				var size int64
+				if err = rows.Scan(&key, &size); err != nil {
+					rows.Close()
+					return err
+				}
+				keys = append(keys, key)
+				names = append(names, key)
+				count--
+				total -= size
+			}
+			rows.Close()
+
+			if len(keys) == 0 {
+				break
+			}
+			if _, err = tx.Exec("DELETE FROM cache WHERE key IN ("+placeholders(len(keys))+")", keys...); err != nil {
+				return err
+			}
+			evicted = append(evicted, names...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.notify(EventExpire, expired...)
+	c.notify(EventRemove, evicted...)
+	if len(evicted) > 0 {
+		log.Printf("DB: %d entries evicted from %s", len(evicted), c.dbpath)
+	}
+	return nil
+}
+
+func (c *PermanentCache) overBudget(count int64, total int64) bool {
+	return (c.MaxRows > 0 && count > c.MaxRows) || (c.MaxBytes > 0 && total > c.MaxBytes)
+}
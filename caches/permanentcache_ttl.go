@@ -0,0 +1,96 @@
+package caches
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// rows with NULL expires live forever
+const notExpired = "(expires IS NULL OR expires > ?)"
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// RemoveExpired deletes expired rows and returns how many were removed.
+func (c *PermanentCache) RemoveExpired() (int64, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := nowMs()
+
+	var freed int64
+	var keys []string
+	err := c.writeTx(func(tx *sql.Tx) (err error) {
+		if err = tx.QueryRow("SELECT COALESCE(SUM(size), 0) FROM cache WHERE expires <= ?", now).Scan(&freed); err != nil {
+			return err
+		}
+		keys, err = deleteReturning(tx, "DELETE FROM cache WHERE expires <= ? RETURNING key", now)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.freed += freed
+	c.notify(EventExpire, keys...)
+	return int64(len(keys)), nil
+}
+
+// StartSweeper removes expired rows every interval until StopSweeper or Close.
+// A read-only cache has no sweeper.
+func (c *PermanentCache) StartSweeper(interval time.Duration) {
+	c.StopSweeper()
+	if c.ReadOnly {
+		log.Println("DB: no sweeper for read-only " + c.dbpath)
+		return
+	}
+
+	stop := make(chan struct{})
+	c.sweeper = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.sweep()
+			}
+		}
+	}()
+}
+
+func (c *PermanentCache) StopSweeper() {
+	if c.sweeper != nil {
+		close(c.sweeper)
+		c.sweeper = nil
+	}
+}
+
+func (c *PermanentCache) sweep() {
+	n, err := c.RemoveExpired()
+	if err != nil {
+		log.Println("DB: sweep failed:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("DB: %d expired entries removed from %s", n, c.dbpath)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.VacuumAfter > 0 && c.freed >= c.VacuumAfter {
+		c.freed = 0
+		log.Println("DB: vacuum " + c.dbpath)
+		c.Exec("VACUUM;")
+	}
+}
@@ -0,0 +1,253 @@
+package caches
+
+import (
+	"iter"
+	"strings"
+	"time"
+)
+
+type Order int
+
+const (
+	OrderKey Order = iota
+	OrderKeyDesc
+	OrderCreated
+	OrderCreatedDesc
+)
+
+// Query filters entries of PermanentCache. Empty fields match everything.
+type Query struct {
+	Prefix string
+	// Glob is a SQLite GLOB pattern, case sensitive: "*.html", "img/?/*"
+	Glob    string
+	Kinds   []string
+	Comment string
+	Tag     string
+	// Attrs match top level attributes by value.
+	Attrs map[string]any
+	// CreatedFrom is inclusive, CreatedTo exclusive.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+
+	Offset int
+	// Limit: zero means no limit.
+	Limit int
+	Order Order
+}
+
+type Entry struct {
+	Key     string
+	Comment string
+	Kind    string
+	Created time.Time
+	Value   []byte
+}
+
+// rows are read in pages, the lock is released while the caller iterates
+const queryPageSize = 256
+
+// format of CURRENT_TIMESTAMP
+const sqliteTime = "2006-01-02 15:04:05"
+
+func (q *Query) where() (string, []any) {
+	conds := []string{notExpired}
+	args := []any{nowMs()}
+
+	if q.Prefix != "" {
+		conds = append(conds, "key >= ?")
+		args = append(args, q.Prefix)
+		if end, ok := prefixEnd(q.Prefix); ok {
+			conds = append(conds, "key < ?")
+			args = append(args, end)
+		}
+	}
+	if q.Glob != "" {
+		conds = append(conds, "key GLOB ?")
+		args = append(args, q.Glob)
+	}
+	if len(q.Kinds) > 0 {
+		conds = append(conds, "kind IN ("+placeholders(len(q.Kinds))+")")
+		for _, k := range q.Kinds {
+			args = append(args, k)
+		}
+	}
+	if q.Comment != "" {
+		conds = append(conds, "comment = ?")
+		args = append(args, q.Comment)
+	}
+	if q.Tag != "" {
+		conds = append(conds, "key IN (SELECT key FROM tags WHERE tag = ?)")
+		args = append(args, q.Tag)
+	}
+	for name, value := range q.Attrs {
+		conds = append(conds, "key IN (SELECT key FROM cache WHERE json_extract(attrs, ?) = ?)")
+		args = append(args, attrPath(name), value)
+	}
+	if !q.CreatedFrom.IsZero() {
+		conds = append(conds, "created >= ?")
+		args = append(args, q.CreatedFrom.UTC().Format(sqliteTime))
+	}
+	if !q.CreatedTo.IsZero() {
+		conds = append(conds, "created < ?")
+		args = append(args, q.CreatedTo.UTC().Format(sqliteTime))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// prefixEnd is the smallest string greater than all strings with the prefix.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// page continues after the last row of the previous page
+func (q *Query) page(cols string, last *Entry, size int) (string, []any) {
+	where, args := q.where()
+
+	var order string
+	switch q.Order {
+	case OrderKeyDesc:
+		order = "key DESC"
+		if last != nil {
+			where += " AND key < ?"
+			args = append(args, last.Key)
+		}
+	case OrderCreated:
+		order = "created, key"
+		if last != nil {
+			where += " AND (created, key) > (?, ?)"
+			args = append(args, last.Created.Format(sqliteTime), last.Key)
+		}
+	case OrderCreatedDesc:
+		order = "created DESC, key DESC"
+		if last != nil {
+			where += " AND (created, key) < (?, ?)"
+			args = append(args, last.Created.Format(sqliteTime), last.Key)
+		}
+	default:
+		order = "key"
+		if last != nil {
+			where += " AND key > ?"
+			args = append(args, last.Key)
+		}
+	}
+
+	query := "SELECT " + cols + " FROM entries WHERE " + where + " ORDER BY " + order + " LIMIT ?"
+	args = append(args, size)
+	if last == nil && q.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, q.Offset)
+	}
+	return query, args
+}
+
+// Count returns the number of entries matching the filters, Offset and Limit are ignored.
+func (c *PermanentCache) Count(q Query) (int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	where, args := q.where()
+	var count int64
+	err := c.DB.QueryRow("SELECT COUNT(*) FROM entries WHERE "+where, args...).Scan(&count)
+	return count, err
+}
+
+// Keys iterates keys without loading values.
+func (c *PermanentCache) Keys(q Query) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for e, err := range c.scan(q, false) {
+			if !yield(e.Key, err) {
+				return
+			}
+		}
+	}
+}
+
+// Entries iterates decoded entries.
+func (c *PermanentCache) Entries(q Query) iter.Seq2[Entry, error] {
+	return c.scan(q, true)
+}
+
+func (c *PermanentCache) scan(q Query, values bool) iter.Seq2[Entry, error] {
+	cols := "key, comment, kind, CAST(created AS TEXT)"
+	if values {
+		cols += ", COALESCE(keyid, ''), value, checksum"
+	}
+
+	return func(yield func(Entry, error) bool) {
+		var last *Entry
+		count := 0
+		for {
+			// values beyond Limit are not read and decoded
+			size := queryPageSize
+			if q.Limit > 0 {
+				size = min(size, q.Limit-count)
+			}
+			if size <= 0 {
+				return
+			}
+			page, err := c.readPage(q, cols, values, last, size)
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			for i := range page {
+				count++
+				if !yield(page[i], nil) {
+					return
+				}
+			}
+			if len(page) < size {
+				return
+			}
+			last = &page[len(page)-1]
+		}
+	}
+}
+
+func (c *PermanentCache) readPage(q Query, cols string, values bool, last *Entry, size int) ([]Entry, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	query, args := q.page(cols, last, size)
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]Entry, 0, size)
+	for rows.Next() {
+		var e Entry
+		var created string
+		var keyid string
+		var value, sum []byte
+		dest := []any{&e.Key, &e.Comment, &e.Kind, &created}
+		if values {
+			dest = append(dest, &keyid, &value, &sum)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if e.Created, err = time.Parse(sqliteTime, created); err != nil {
+			return nil, err
+		}
+		if values {
+			if e.Value, err = c.decodeRow(e.Key, e.Kind, keyid, value, sum, c.VerifyOnGet); err != nil {
+				return nil, err
+			}
+		}
+		page = append(page, e)
+	}
+	return page, rows.Err()
+}
@@ -2,9 +2,11 @@ package caches
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,13 +15,49 @@ import (
 
 type TarCache struct {
 	Name string
-	file *os.File
-	lock sync.Mutex
+	// Codec compresses entries added by PutFile and PutBytes.
+	// Entries are readable whatever codec was used to write them.
+	Codec string
+	// IndexPath is the sidecar file with entry offsets, empty disables it.
+	IndexPath string
+	// Sync flushes every append to disk.
+	Sync bool
+
+	file  *os.File
+	lock  sync.Mutex
+	index *tarIndex
+	dirty bool
+}
+
+// tar PAX record holding the codec name
+const paxCodec = "GOUTILS.codec"
+
+// tar PAX record holding the size before compression
+const paxSize = "GOUTILS.size"
+
+// tar PAX record of an empty entry hiding the previous versions,
+// standard tar extracts it as an empty file.
+const paxDeleted = "GOUTILS.deleted"
+
+// newHeader takes the size before compression, the stored size is set by the caller.
+func (c *TarCache) newHeader(name string, size int64, mode int64, modTime time.Time) *tar.Header {
+	header := &tar.Header{
+		Name:    name,
+		Size:    size,
+		Mode:    mode,
+		ModTime: modTime,
+	}
+	if c.Codec != "" {
+		header.PAXRecords = map[string]string{paxCodec: c.Codec, paxSize: strconv.FormatInt(size, 10)}
+		header.Format = tar.FormatPAX
+	}
+	return header
 }
 
 func NewTarCache(fname string) *TarCache {
 	return &TarCache{
-		Name: fname,
+		Name:      fname,
+		IndexPath: fname + ".idx",
 	}
 }
 
@@ -37,52 +75,58 @@ func (c *TarCache) Open() error {
 		return err
 	}
 	c.file = f
+
+	if err = c.loadIndex(); err != nil {
+		f.Close()
+		c.file = nil
+		return err
+	}
 	return nil
 }
 
 func (c *TarCache) Close() error {
+	c.closeIndex()
 	return c.file.Close()
 }
 
-func bufEmpty(buf []byte) bool {
-	for _, v := range buf {
-		if v != 0 {
-			return false
-		}
+// seekToAppend moves to the end of the last entry. End blocks are cut off,
+// so an interrupted append always leaves a short file.
+func (c *TarCache) seekToAppend() error {
+	if err := c.file.Truncate(c.index.End); err != nil {
+		return err
 	}
-	return true
+	_, err := c.file.Seek(c.index.End, io.SeekStart)
+	return err
 }
 
-// We might have zero, one or two end blocks.
-// The standard is two, but we should try to handle other cases.
-func (c *TarCache) seekToAppend() error {
-	fi, err := c.file.Stat()
-	if err != nil {
+// writeEntry appends the header and the data copied from r, and indexes the entry.
+func (c *TarCache) writeEntry(header *tar.Header, r io.Reader) error {
+	if err := c.seekToAppend(); err != nil {
 		return err
 	}
-	if fi.Size() < 1024 {
-		return nil
-	}
+	offset := c.index.End
 
-	buf := make([]byte, 512)
-
-	if _, err = c.file.Seek(-1024, io.SeekEnd); err != nil {
+	tw := tar.NewWriter(c.file)
+	if err := tw.WriteHeader(header); err != nil {
 		return err
 	}
-	if num, err := c.file.Read(buf); num != 512 || err != nil {
+	data, err := c.file.Seek(0, io.SeekCurrent)
+	if err != nil {
 		return err
 	}
-	if bufEmpty(buf) {
-		c.file.Seek(-1024, io.SeekEnd)
-		return nil
+	if _, err = io.Copy(tw, r); err != nil {
+		return err
 	}
-
-	if num, err := c.file.Read(buf); num != 512 || err != nil {
+	if err = tw.Close(); err != nil {
 		return err
 	}
-	if bufEmpty(buf) {
-		c.file.Seek(-512, io.SeekEnd)
+	if c.Sync {
+		if err = c.file.Sync(); err != nil {
+			return err
+		}
 	}
+	c.index.add(header.Name, newTarEntry(offset, data, header))
+	c.dirty = true
 	return nil
 }
 
@@ -101,136 +145,99 @@ func (c *TarCache) PutFile(path string) error {
 		return err
 	}
 
-	if err = c.seekToAppend(); err != nil {
-		return err
-	}
-
-	// add file
-	tw := tar.NewWriter(c.file)
-
-	header := &tar.Header{
-		Name:    filepath.Base(path),
-		Size:    stat.Size(),
-		Mode:    int64(stat.Mode()),
-		ModTime: stat.ModTime(),
-	}
+	return c.putReader(c.newHeader(filepath.Base(path), stat.Size(), int64(stat.Mode()), stat.ModTime()), file)
+}
 
-	if err := tw.WriteHeader(header); err != nil {
-		return err
-	}
-	if _, err := io.Copy(tw, file); err != nil {
-		return err
+// entries are always stored in the streaming format of the codec
+func (c *TarCache) encode(data []byte) ([]byte, error) {
+	codec, err := LookupCodec(c.Codec)
+	if err != nil {
+		return nil, err
 	}
-	return tw.Close()
+	return encodeStream(codec, data)
 }
 
 func (c *TarCache) PutBytes(path string, data []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if err := c.seekToAppend(); err != nil {
-		return nil
-	}
-
-	// add file
-	tw := tar.NewWriter(c.file)
-
-	header := &tar.Header{
-		Name:    path,
-		Size:    int64(len(data)),
-		Mode:    0600,
-		ModTime: time.Now(),
+	header := c.newHeader(path, int64(len(data)), 0600, time.Now())
+	if c.Codec != "" {
+		var err error
+		if data, err = c.encode(data); err != nil {
+			return err
+		}
+		header.Size = int64(len(data))
 	}
+	return c.appendBytes(header, data)
+}
 
-	if err := tw.WriteHeader(header); err != nil {
-		return err
-	}
-	if _, err := tw.Write(data); err != nil {
-		return err
-	}
-	return tw.Close()
+func (c *TarCache) appendBytes(header *tar.Header, data []byte) error {
+	return c.writeEntry(header, bytes.NewReader(data))
 }
 
+// GetBytes returns the first or the last stored version, nil if there is none.
 func (c *TarCache) GetBytes(path string, first bool) ([]byte, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+	e, ok := c.index.lookup(path, first)
+	if !ok {
+		return nil, nil
 	}
+	return c.readIndexed(e)
+}
 
-	var buf []byte = nil
-	tr := tar.NewReader(c.file)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+func (c *TarCache) ListFiles() ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		if hdr.Name == path {
-			buf, _ = io.ReadAll(tr)
-			if first {
-				break
-			}
+	list := make([]string, 0, len(c.index.Files))
+	for f := range c.index.Files {
+		if _, ok := c.index.lookup(f, false); ok {
+			list = append(list, f)
 		}
 	}
-	return buf, nil
+	return list, nil
 }
 
-func (c *TarCache) ListFiles() ([]string, error) {
+// Remove appends a tombstone, the data stays in the archive until Compact.
+func (c *TarCache) Remove(path string) (bool, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+	if _, ok := c.index.lookup(path, false); !ok {
+		return false, nil
 	}
-
-	dic := make(map[string]bool)
-	tr := tar.NewReader(c.file)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		dic[hdr.Name] = true
+	header := &tar.Header{
+		Name:       path,
+		Mode:       0600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{paxDeleted: "1"},
+		Format:     tar.FormatPAX,
 	}
-
-	list := make([]string, 0)
-	for f := range dic {
-		list = append(list, f)
+	if err := c.writeEntry(header, bytes.NewReader(nil)); err != nil {
+		return false, err
 	}
-	return list, nil
+	return true, nil
 }
 
+// MemCache reads the last version of every file.
 func (c *TarCache) MemCache() (map[string][]byte, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	cache := make(map[string][]byte)
-	tr := tar.NewReader(c.file)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err == nil {
-			cache[hdr.Name], err = io.ReadAll(tr)
+	cache := make(map[string][]byte, len(c.index.Files))
+	for name := range c.index.Files {
+		e, ok := c.index.lookup(name, false)
+		if !ok {
+			continue
 		}
+		data, err := c.readIndexed(e)
 		if err != nil {
 			return nil, err
 		}
+		cache[name] = data
 	}
-
 	return cache, nil
 }
@@ -0,0 +1,115 @@
+package caches
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Compact rewrites the archive keeping one version of each name, the first or the last.
+// Removed names and non-regular entries, like directories, are dropped.
+// The copy is synced and renamed over the archive, an interrupted compaction
+// leaves the archive intact. It returns the number of bytes reclaimed.
+func (c *TarCache) Compact(ctx context.Context, first bool) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fi, err := c.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// keep the order of the archive
+	keep := make([]namedEntry, 0, len(c.index.Files))
+	for name := range c.index.Files {
+		e, ok := c.index.lookup(name, first)
+		if !ok {
+			continue
+		}
+		keep = append(keep, namedEntry{name, e})
+	}
+	slices.SortFunc(keep, func(a, b namedEntry) int { return cmp.Compare(a.Offset, b.Offset) })
+
+	tmp := c.Name + ".compact"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := c.copyEntries(ctx, out, keep)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	c.file.Close()
+	if err = os.Rename(tmp, c.Name); err != nil {
+		os.Remove(tmp)
+		if rerr := c.reopen(nil); rerr != nil {
+			log.Println("TAR: reopen failed:", rerr)
+		}
+		return 0, err
+	}
+	syncDir(filepath.Dir(c.Name))
+	if err = c.reopen(idx); err != nil {
+		return 0, err
+	}
+
+	reclaimed := fi.Size() - idx.End - 1024
+	log.Printf("TAR: %s compacted, %d bytes reclaimed", c.Name, reclaimed)
+	return reclaimed, nil
+}
+
+type namedEntry struct {
+	name string
+	tarEntry
+}
+
+// copyEntries copies headers and data unchanged and closes the archive with two end blocks.
+func (c *TarCache) copyEntries(ctx context.Context, out io.Writer, keep []namedEntry) (*tarIndex, error) {
+	idx := newTarIndex()
+	for _, e := range keep {
+		r := io.NewSectionReader(c.file, e.Offset, e.end()-e.Offset)
+		if _, err := io.Copy(out, ctxReader{ctx, r}); err != nil {
+			return nil, err
+		}
+		shift := idx.End - e.Offset
+		e.Offset += shift
+		e.Data += shift
+		idx.add(e.name, e.tarEntry)
+	}
+	_, err := out.Write(make([]byte, 1024))
+	return idx, err
+}
+
+// reopen opens the archive after it was replaced, a nil index is rebuilt.
+func (c *TarCache) reopen(idx *tarIndex) error {
+	f, err := os.OpenFile(c.Name, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	if idx == nil {
+		return c.loadIndex()
+	}
+	c.index = idx
+	c.dirty = true
+	return nil
+}
+
+// syncDir makes a rename durable, not supported on windows.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
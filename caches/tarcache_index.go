@@ -0,0 +1,237 @@
+package caches
+
+import (
+	"archive/tar"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// tarEntry locates one version of a file in the archive.
+type tarEntry struct {
+	// Offset of the first header block, PAX records included.
+	Offset int64
+	// Data is the offset of the stored bytes.
+	Data int64
+	// Size is stored, Original is before compression, -1 if unknown.
+	Size     int64
+	Original int64
+	Codec    string
+	Mode     int64
+	ModTime  time.Time
+	// Deleted marks a tombstone written by Remove.
+	Deleted bool
+	// Type is the tar Typeflag, only regular files are looked up.
+	Type byte
+}
+
+// regular also accepts the unset flag of headers written by the cache
+func (e *tarEntry) regular() bool {
+	return e.Type == tar.TypeReg || e.Type == 0
+}
+
+// end is the offset after the padded data
+func (e *tarEntry) end() int64 {
+	return e.Data + blockPadded(e.Size)
+}
+
+func blockPadded(size int64) int64 {
+	return (size + 511) &^ 511
+}
+
+// tarIndexVersion changes with tarEntry, older sidecar files are rebuilt.
+const tarIndexVersion = 1
+
+// tarIndex is saved to the sidecar file, FileSize and FileTime
+// tell if it still describes the archive.
+type tarIndex struct {
+	Version  int
+	FileSize int64
+	FileTime time.Time
+	End      int64
+	// versions of each name in the order they were appended,
+	// a removed name has only its tombstone
+	Files map[string][]tarEntry
+}
+
+func newTarIndex() *tarIndex {
+	return &tarIndex{Version: tarIndexVersion, Files: make(map[string][]tarEntry)}
+}
+
+func (idx *tarIndex) add(name string, e tarEntry) {
+	versions := idx.Files[name]
+	if e.Deleted || (len(versions) > 0 && versions[0].Deleted) {
+		versions = nil
+	}
+	idx.Files[name] = append(versions, e)
+	idx.End = e.end()
+}
+
+// lookup skips directories, links and other non-regular entries.
+func (idx *tarIndex) lookup(name string, first bool) (tarEntry, bool) {
+	versions := idx.Files[name]
+	if len(versions) == 0 || versions[0].Deleted {
+		return tarEntry{}, false
+	}
+	e := versions[len(versions)-1]
+	if first {
+		e = versions[0]
+	}
+	return e, e.regular()
+}
+
+func newTarEntry(offset int64, data int64, hdr *tar.Header) tarEntry {
+	e := tarEntry{
+		Offset:   offset,
+		Data:     data,
+		Size:     hdr.Size,
+		Original: hdr.Size,
+		Codec:    hdr.PAXRecords[paxCodec],
+		Mode:     hdr.Mode,
+		ModTime:  hdr.ModTime,
+		Deleted:  hdr.PAXRecords[paxDeleted] != "",
+		Type:     hdr.Typeflag,
+	}
+	if e.Codec != "" {
+		var err error
+		if e.Original, err = strconv.ParseInt(hdr.PAXRecords[paxSize], 10, 64); err != nil {
+			e.Original = -1
+		}
+	}
+	return e
+}
+
+// loadIndex reads the sidecar file or scans the archive.
+func (c *TarCache) loadIndex() error {
+	fi, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+	if c.IndexPath != "" {
+		if idx, err := readTarIndex(c.IndexPath); err == nil && idx.Version == tarIndexVersion && idx.FileSize == fi.Size() && idx.FileTime.Equal(fi.ModTime()) {
+			c.index = idx
+			return nil
+		}
+	}
+
+	c.index, err = c.scanIndex(fi.Size())
+	c.dirty = true
+	if err != nil {
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%s: %w at offset %d, Repair drops the rest", c.Name, err, c.index.End)
+		}
+		// a torn append
+		_, err = c.truncateTail()
+	}
+	return err
+}
+
+// scanIndex reads all headers, the data is skipped by seeking.
+// On error the index holds the complete entries before the failed one.
+func (c *TarCache) scanIndex(size int64) (*tarIndex, error) {
+	idx := newTarIndex()
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return idx, err
+	}
+
+	tr := tar.NewReader(c.file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return idx, err
+		}
+		// tar.Reader does not read ahead, the file is at the data now
+		data, err := c.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return idx, err
+		}
+		e := newTarEntry(idx.End, data, hdr)
+		if e.end() > size {
+			return idx, io.ErrUnexpectedEOF
+		}
+		idx.add(hdr.Name, e)
+	}
+	return idx, nil
+}
+
+func readTarIndex(path string) (*tarIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := &tarIndex{}
+	if err = gob.NewDecoder(f).Decode(idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// saveIndex writes the sidecar file if the index has changed.
+func (c *TarCache) saveIndex() error {
+	if c.IndexPath == "" || !c.dirty {
+		return nil
+	}
+	fi, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+	c.index.FileSize = fi.Size()
+	c.index.FileTime = fi.ModTime()
+
+	tmp := c.IndexPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(c.index); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, c.IndexPath); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// readIndexed reads and decodes one version without scanning the archive.
+func (c *TarCache) readIndexed(e tarEntry) ([]byte, error) {
+	r, err := c.openIndexed(e)
+	if err != nil {
+		return nil, err
+	}
+	return readAllClose(r)
+}
+
+func (c *TarCache) openIndexed(e tarEntry) (io.ReadCloser, error) {
+	r := io.NewSectionReader(c.file, e.Data, e.Size)
+	if e.Codec == "" {
+		return io.NopCloser(r), nil
+	}
+	codec, err := LookupCodec(e.Codec)
+	if err != nil {
+		return nil, err
+	}
+	return codec.NewReader(r)
+}
+
+func (c *TarCache) closeIndex() {
+	if err := c.saveIndex(); err != nil {
+		log.Println("TAR: index not saved:", err)
+	}
+}
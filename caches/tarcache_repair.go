@@ -0,0 +1,55 @@
+package caches
+
+import (
+	"log"
+	"os"
+)
+
+// Repair drops everything after the last complete entry. Open does it
+// for torn appends, Repair also cuts off damaged headers.
+// It may be called instead of Open and returns the number of bytes discarded.
+func (c *TarCache) Repair() (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file == nil {
+		f, err := os.OpenFile(c.Name, os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return 0, err
+		}
+		c.file = f
+	}
+
+	fi, err := c.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	c.index, err = c.scanIndex(fi.Size())
+	c.dirty = true
+	if err == nil {
+		return 0, nil
+	}
+	log.Printf("TAR: %s: %v", c.Name, err)
+	return c.truncateTail()
+}
+
+// truncateTail cuts the file after the indexed entries and closes the archive with end blocks.
+func (c *TarCache) truncateTail() (int64, error) {
+	fi, err := c.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	discarded := fi.Size() - c.index.End
+
+	if err = c.file.Truncate(c.index.End); err != nil {
+		return 0, err
+	}
+	if _, err = c.file.WriteAt(make([]byte, 1024), c.index.End); err != nil {
+		return 0, err
+	}
+	if err = c.file.Sync(); err != nil {
+		return 0, err
+	}
+	log.Printf("TAR: %s: %d bytes of an incomplete entry discarded at offset %d", c.Name, discarded, c.index.End)
+	return discarded, nil
+}
@@ -0,0 +1,178 @@
+package caches
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// PutReader stores size bytes read from r without loading them into memory.
+// With Codec set the compressed data is staged in a temporary file next to the archive.
+func (c *TarCache) PutReader(name string, size int64, modTime time.Time, r io.Reader) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.putReader(c.newHeader(name, size, 0600, modTime), r)
+}
+
+func (c *TarCache) putReader(header *tar.Header, r io.Reader) error {
+	if c.Codec == "" {
+		return c.writeEntry(header, r)
+	}
+
+	// compressed size must be known before the header is written
+	tmp, err := os.CreateTemp(filepath.Dir(c.Name), filepath.Base(c.Name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	codec, err := LookupCodec(c.Codec)
+	if err != nil {
+		return err
+	}
+	w, err := codec.NewWriter(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != header.Size {
+		return fmt.Errorf("%s: %d bytes read, %d expected", header.Name, n, header.Size)
+	}
+
+	if header.Size, err = tmp.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return c.writeEntry(header, tmp)
+}
+
+// OpenFile returns a reader of the last version. The reader must be closed
+// before Compact, which replaces the archive file.
+func (c *TarCache) OpenFile(name string) (io.ReadCloser, fs.FileInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.index.lookup(name, false)
+	if !ok {
+		return nil, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	r, err := c.openIndexed(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, &tarFileInfo{name: name, e: e}, nil
+}
+
+type tarFileInfo struct {
+	name string
+	e    tarEntry
+}
+
+func (fi *tarFileInfo) Name() string { return path.Base(fi.name) }
+
+// Size is the stored size when the size before compression is unknown.
+func (fi *tarFileInfo) Size() int64 {
+	if fi.e.Original >= 0 {
+		return fi.e.Original
+	}
+	return fi.e.Size
+}
+
+func (fi *tarFileInfo) Mode() fs.FileMode  { return fs.FileMode(fi.e.Mode) & fs.ModePerm }
+func (fi *tarFileInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi *tarFileInfo) IsDir() bool        { return false }
+func (fi *tarFileInfo) Sys() any           { return nil }
+
+// PutDir stores regular files under root with slash separated relative names.
+func (c *TarCache) PutDir(root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return c.putPath(p, filepath.ToSlash(rel))
+	})
+}
+
+func (c *TarCache) putPath(p string, name string) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.putReader(c.newHeader(name, stat.Size(), int64(stat.Mode().Perm()), stat.ModTime()), file)
+}
+
+// ExtractTo writes the last version of every regular file under dir in name order.
+// Directories are created as needed, links and other entries are skipped.
+// Names leaving dir, like absolute paths or "../x", are rejected.
+func (c *TarCache) ExtractTo(dir string) error {
+	files, err := c.ListFiles()
+	if err != nil {
+		return err
+	}
+	slices.Sort(files)
+	for _, name := range files {
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("%s: unsafe path %q", c.Name, name)
+		}
+	}
+	for _, name := range files {
+		if err = c.extractFile(name, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *TarCache) extractFile(name string, dst string) error {
+	r, fi, err := c.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,316 @@
+package caches
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+type WritePolicy int
+
+const (
+	// WriteThrough stores values in PermanentCache before Put returns.
+	WriteThrough WritePolicy = iota
+	// WriteBehind queues values and stores them on Flush.
+	WriteBehind
+)
+
+type TierStats struct {
+	MemHits    int64
+	MemMisses  int64
+	DiskHits   int64
+	DiskMisses int64
+	Pending    int
+}
+
+// TieredCache keeps recently used decoded values in memory
+// in front of a PermanentCache.
+type TieredCache struct {
+	Cache      *PermanentCache
+	MaxEntries int
+	Policy     WritePolicy
+
+	lock    sync.Mutex
+	lru     *list.List
+	items   map[string]*list.Element
+	pending map[string]*pendingWrite
+	stats   TierStats
+
+	// seq counts changes of keys, changed holds the seq of the last
+	// change of a key while disk reads are in flight
+	seq     uint64
+	changed map[string]uint64
+	reads   int
+
+	flusher chan struct{}
+}
+
+type tieredItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// pendingWrite is a queued Put or Remove
+type pendingWrite struct {
+	comment  string
+	data     []byte
+	compress string
+	remove   bool
+	expires  time.Time
+}
+
+// expired is false for the zero time, which means no TTL
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
+
+func NewTieredCache(cache *PermanentCache, maxEntries int, policy WritePolicy) *TieredCache {
+	return &TieredCache{
+		Cache:      cache,
+		MaxEntries: maxEntries,
+		Policy:     policy,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+		pending:    make(map[string]*pendingWrite),
+		changed:    make(map[string]uint64),
+	}
+}
+
+// Get returns nil for missing keys like PermanentCache.Get.
+// The returned slice is shared, do not modify it.
+func (t *TieredCache) Get(key string) ([]byte, error) {
+	t.lock.Lock()
+	if el, ok := t.items[key]; ok {
+		item := el.Value.(*tieredItem)
+		if !expired(item.expires) {
+			t.lru.MoveToFront(el)
+			t.stats.MemHits++
+			t.lock.Unlock()
+			return item.data, nil
+		}
+		t.lru.Remove(el)
+		delete(t.items, key)
+	}
+	if p, ok := t.pending[key]; ok {
+		t.stats.MemHits++
+		t.lock.Unlock()
+		if p.remove || expired(p.expires) {
+			return nil, nil
+		}
+		return p.data, nil
+	}
+	t.stats.MemMisses++
+	start := t.seq
+	t.reads++
+	t.lock.Unlock()
+
+	data, expires, found, err := t.Cache.lookupExpiring(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// a Put or Remove could have happened while the lock was released
+	stale := t.changed[key] > start
+	if t.reads--; t.reads == 0 {
+		clear(t.changed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		t.stats.DiskMisses++
+		return nil, nil
+	}
+	t.stats.DiskHits++
+	if _, ok := t.pending[key]; !ok && !stale {
+		t.set(key, data, expires)
+	}
+	return data, nil
+}
+
+// Put applies DefaultTTL of the PermanentCache to the memory tier as well.
+func (t *TieredCache) Put(key string, comment string, data []byte, compress string) error {
+	var expires time.Time
+	if ttl := t.Cache.DefaultTTL; ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if t.Policy == WriteThrough {
+		if err := t.Cache.Put(key, comment, data, compress); err != nil {
+			t.Invalidate(key)
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Policy == WriteBehind {
+		t.pending[key] = &pendingWrite{comment: comment, data: data, compress: compress, expires: expires}
+	}
+	t.changing(key)
+	t.set(key, data, expires)
+	return nil
+}
+
+func (t *TieredCache) Remove(key string) (bool, error) {
+	if t.Policy == WriteThrough {
+		// after the row is gone, a concurrent Get could cache it again otherwise
+		removed, err := t.Cache.Remove(key)
+		t.Invalidate(key)
+		return removed, err
+	}
+
+	t.lock.Lock()
+	p, queued := t.pending[key]
+	t.lock.Unlock()
+
+	var found bool
+	if queued {
+		found = !p.remove && !expired(p.expires)
+	} else {
+		var err error
+		if found, err = t.Cache.Contains(key); err != nil {
+			return false, err
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[key] = &pendingWrite{remove: true}
+	t.drop(key)
+	return found, nil
+}
+
+// Invalidate drops the key from memory only, e.g. after the
+// underlying PermanentCache was changed directly.
+func (t *TieredCache) Invalidate(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.drop(key)
+}
+
+// drop expects the lock to be held.
+func (t *TieredCache) drop(key string) {
+	t.changing(key)
+	if el, ok := t.items[key]; ok {
+		t.lru.Remove(el)
+		delete(t.items, key)
+	}
+}
+
+// changing keeps Get from caching a value read before the change.
+// It expects the lock to be held.
+func (t *TieredCache) changing(key string) {
+	t.seq++
+	if t.reads > 0 {
+		t.changed[key] = t.seq
+	}
+}
+
+func (t *TieredCache) Stats() TierStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.stats
+	s.Pending = len(t.pending)
+	return s
+}
+
+// set expects the lock to be held.
+func (t *TieredCache) set(key string, data []byte, expires time.Time) {
+	if el, ok := t.items[key]; ok {
+		item := el.Value.(*tieredItem)
+		item.data, item.expires = data, expires
+		t.lru.MoveToFront(el)
+		return
+	}
+	t.items[key] = t.lru.PushFront(&tieredItem{key: key, data: data, expires: expires})
+
+	for t.MaxEntries > 0 && t.lru.Len() > t.MaxEntries {
+		el := t.lru.Back()
+		t.lru.Remove(el)
+		delete(t.items, el.Value.(*tieredItem).key)
+	}
+}
+
+// Flush stores queued writes in a single transaction. Writes stay
+// visible through the queue until they are committed.
+func (t *TieredCache) Flush() error {
+	t.lock.Lock()
+	pending := make(map[string]*pendingWrite, len(t.pending))
+	for key, p := range t.pending {
+		pending[key] = p
+	}
+	t.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	b, err := t.Cache.NewBatch()
+	if err != nil {
+		return err
+	}
+	for key, p := range pending {
+		if p.remove {
+			_, err = b.Remove(key)
+		} else {
+			err = b.Put(key, p.comment, p.data, p.compress)
+		}
+		if err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+	if err = b.Commit(); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, p := range pending {
+		// unless replaced by a newer write
+		if t.pending[key] == p {
+			delete(t.pending, key)
+		}
+	}
+	return nil
+}
+
+// StartFlusher flushes queued writes every interval until Close.
+func (t *TieredCache) StartFlusher(interval time.Duration) {
+	t.stopFlusher()
+
+	stop := make(chan struct{})
+	t.flusher = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := t.Flush(); err != nil {
+					log.Println("DB: write-behind flush failed:", err)
+				}
+			}
+		}
+	}()
+}
+
+func (t *TieredCache) stopFlusher() {
+	if t.flusher != nil {
+		close(t.flusher)
+		t.flusher = nil
+	}
+}
+
+// Close flushes queued writes, the PermanentCache stays open.
+func (t *TieredCache) Close() error {
+	t.stopFlusher()
+	return t.Flush()
+}
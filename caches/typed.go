@@ -0,0 +1,113 @@
+package caches
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Serializer converts values stored by Typed.
+type Serializer interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type JSONSerializer struct{}
+
+func (JSONSerializer) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONSerializer) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type GobSerializer struct{}
+
+func (GobSerializer) Marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobSerializer) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinarySerializer uses encoding.BinaryMarshaler if implemented,
+// otherwise the value must be fixed-size for encoding/binary.
+type BinarySerializer struct{}
+
+func (BinarySerializer) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return binary.Append(nil, binary.LittleEndian, v)
+}
+
+func (BinarySerializer) Unmarshal(data []byte, v any) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	_, err := binary.Decode(data, binary.LittleEndian, v)
+	return err
+}
+
+// Typed stores Go values in a PermanentCache.
+type Typed[T any] struct {
+	Cache      *PermanentCache
+	Serializer Serializer
+	Compress   string
+}
+
+func NewTyped[T any](cache *PermanentCache, serializer Serializer, compress string) *Typed[T] {
+	return &Typed[T]{
+		Cache:      cache,
+		Serializer: serializer,
+		Compress:   compress,
+	}
+}
+
+// Get returns false for missing or expired keys.
+func (t *Typed[T]) Get(key string) (T, bool, error) {
+	var v T
+	data, found, err := t.Cache.Lookup(key)
+	if !found || err != nil {
+		return v, false, err
+	}
+	err = t.Serializer.Unmarshal(data, &v)
+	return v, err == nil, err
+}
+
+func (t *Typed[T]) Put(key string, v T) error {
+	return t.PutComment(key, "", v)
+}
+
+func (t *Typed[T]) PutComment(key string, comment string, v T) error {
+	// pointer, so that methods with pointer receivers are found
+	data, err := t.Serializer.Marshal(&v)
+	if err != nil {
+		return err
+	}
+	return t.Cache.Put(key, comment, data, t.Compress)
+}
+
+func (t *Typed[T]) Remove(key string) (bool, error) {
+	return t.Cache.Remove(key)
+}
+
+// Range calls fn for every entry until fn returns false.
+func (t *Typed[T]) Range(fn func(key string, v T) bool) error {
+	for e, err := range t.Cache.Entries(Query{}) {
+		if err != nil {
+			return err
+		}
+		var v T
+		if err = t.Serializer.Unmarshal(e.Value, &v); err != nil {
+			return err
+		}
+		if !fn(e.Key, v) {
+			break
+		}
+	}
+	return nil
+}
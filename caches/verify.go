@@ -0,0 +1,214 @@
+package caches
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrCorrupt = errors.New("corrupt cache entry")
+
+// CorruptionError reports a value that can not be decoded or
+// does not match its checksum.
+type CorruptionError struct {
+	Key string
+	// Version is set by Verify for corrupt history versions.
+	Version int
+	Reason  string
+	Err     error
+}
+
+func (e *CorruptionError) Error() string {
+	entry := fmt.Sprintf("%q", e.Key)
+	if e.Version > 0 {
+		entry += fmt.Sprintf(" version %d", e.Version)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("corrupt cache entry %s: %s: %v", entry, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("corrupt cache entry %s: %s", entry, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// checksum of encrypted values is keyed, so that it does not confirm guessed plaintext.
+func (c *PermanentCache) checksum(data []byte, keyed bool) []byte {
+	if keyed {
+		mac := hmac.New(sha256.New, c.ChecksumKey)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// decodeRow checks sum only if verify is set and the row has one.
+func (c *PermanentCache) decodeRow(key string, kind string, keyid string, value []byte, sum []byte, verify bool) ([]byte, error) {
+	value, err := c.unseal(key, kind, keyid, value, sum)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.decode(kind, value)
+	if err != nil {
+		return nil, &CorruptionError{Key: key, Reason: "decode failed", Err: err}
+	}
+	if verify && sum != nil && !bytes.Equal(sum, c.checksum(data, keyid != "")) {
+		return nil, &CorruptionError{Key: key, Reason: "checksum mismatch"}
+	}
+	return data, nil
+}
+
+type VerifyReport struct {
+	Checked     int
+	Quarantined int
+	Corrupt     []*CorruptionError
+}
+
+// Verify decodes every row and every history version and compares checksums.
+// With quarantine set, corrupt rows are moved to the quarantine table.
+func (c *PermanentCache) Verify(ctx context.Context, quarantine bool) (*VerifyReport, error) {
+	if quarantine {
+		if err := c.writable(); err != nil {
+			return nil, err
+		}
+	}
+	report := &VerifyReport{}
+
+	var err error
+	for _, t := range []verifyTable{verifyCache, verifyHistory} {
+		var last, next int64
+		for {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			next, err = c.verifyBatch(t, report, quarantine, last, 100)
+			if err != nil || next == last {
+				break
+			}
+			last = next
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(report.Corrupt) > 0 {
+		log.Printf("DB: %s has %d corrupt entries", c.dbpath, len(report.Corrupt))
+	}
+	return report, err
+}
+
+// verifyTable queries id, key, version, kind, keyid, value, checksum.
+type verifyTable struct {
+	query      string
+	quarantine string
+	remove     string
+	// removed rows are reported to watchers
+	notify bool
+}
+
+var (
+	verifyCache = verifyTable{
+		query: "SELECT id, key, 0, kind, COALESCE(keyid, ''), value, checksum FROM entries WHERE id > ? ORDER BY id LIMIT ?",
+		quarantine: `INSERT INTO quarantine(key, created, comment, kind, value, checksum, keyid, reason)
+			SELECT key, created, comment, kind, value, checksum, keyid, ? FROM entries WHERE id=?`,
+		remove: "DELETE FROM cache WHERE rowid=?",
+		notify: true,
+	}
+	verifyHistory = verifyTable{
+		query: `SELECT h.rowid, h.key, h.version,
+				CASE WHEN h.blob IS NULL THEN h.kind ELSE b.kind END,
+				COALESCE(CASE WHEN h.blob IS NULL THEN h.keyid ELSE b.keyid END, ''),
+				CASE WHEN h.blob IS NULL THEN h.value ELSE b.value END,
+				h.checksum
+			FROM history h LEFT JOIN blobs b ON b.hash=h.blob WHERE h.rowid > ? ORDER BY h.rowid LIMIT ?`,
+		quarantine: `INSERT INTO quarantine(key, created, comment, kind, value, checksum, keyid, reason)
+			SELECT h.key, h.created, h.comment,
+				CASE WHEN h.blob IS NULL THEN h.kind ELSE b.kind END,
+				CASE WHEN h.blob IS NULL THEN h.value ELSE b.value END,
+				h.checksum,
+				CASE WHEN h.blob IS NULL THEN h.keyid ELSE b.keyid END, ?
+			FROM history h LEFT JOIN blobs b ON b.hash=h.blob WHERE h.rowid=?`,
+		remove: "DELETE FROM history WHERE rowid=?",
+	}
+)
+
+func (c *PermanentCache) verifyBatch(t verifyTable, report *VerifyReport, quarantine bool, after int64, limit int) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var checked int
+	var bad []int64
+	var corrupt []*CorruptionError
+	last := after
+	err := c.writeTx(func(tx *sql.Tx) error {
+		checked, bad, corrupt, last = 0, nil, nil, after
+		rows, err := tx.Query(t.query, after, limit)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var id int64
+			var version int
+			var key, kind, keyid string
+			var value, sum []byte
+			if err = rows.Scan(&id, &key, &version, &kind, &keyid, &value, &sum); err != nil {
+				rows.Close()
+				return err
+			}
+			last = id
+			checked++
+
+			if _, err := c.decodeRow(key, kind, keyid, value, sum, true); err != nil {
+				var ce *CorruptionError
+				if !errors.As(err, &ce) {
+					rows.Close()
+					return err
+				}
+				ce.Version = version
+				bad = append(bad, id)
+				corrupt = append(corrupt, ce)
+			}
+		}
+		rows.Close()
+
+		if !quarantine {
+			return nil
+		}
+		for i, id := range bad {
+			if _, err = tx.Exec(t.quarantine, corrupt[i].Error(), id); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(t.remove, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return after, err
+	}
+
+	report.Checked += checked
+	report.Corrupt = append(report.Corrupt, corrupt...)
+	if quarantine {
+		if t.notify {
+			for _, ce := range corrupt {
+				c.notify(EventRemove, ce.Key)
+			}
+		}
+		report.Quarantined += len(bad)
+	}
+	return last, nil
+}
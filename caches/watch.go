@@ -0,0 +1,102 @@
+package caches
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventRemove EventType = "remove"
+	EventExpire EventType = "expire"
+)
+
+type Event struct {
+	Type EventType `json:"event"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// events are dropped if the watcher does not keep up
+const watchBuffer = 256
+
+type watcher struct {
+	prefix   string
+	ch       chan Event
+	overflow bool
+}
+
+// Watch delivers changes of keys with the prefix until ctx is done.
+// Evicted entries are reported as removed.
+func (c *PermanentCache) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+
+	c.watchLock.Lock()
+	if c.watchers == nil {
+		c.watchers = make(map[*watcher]struct{})
+	}
+	c.watchers[w] = struct{}{}
+	c.watchLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.watchLock.Lock()
+		delete(c.watchers, w)
+		close(w.ch)
+		c.watchLock.Unlock()
+	}()
+	return w.ch
+}
+
+func (c *PermanentCache) notify(typ EventType, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+
+	if len(c.watchers) == 0 {
+		return
+	}
+	now := time.Now()
+	for w := range c.watchers {
+		for _, key := range keys {
+			if !strings.HasPrefix(key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- Event{Type: typ, Key: key, Time: now}:
+				w.overflow = false
+			default:
+				if !w.overflow {
+					log.Printf("DB: watcher of %q overflow, events dropped", w.prefix)
+					w.overflow = true
+				}
+			}
+		}
+	}
+}
+
+// deleteReturning runs DELETE ... RETURNING key.
+func deleteReturning(db execer, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -4,14 +4,28 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/zlib"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-
-	"github.com/klauspost/compress/zstd"
 )
 
 func CreateZipFile(zipPath string, files []string) error {
+	return CreateZipFileCodec(zipPath, files, "flate")
+}
+
+// CreateZipFileCodec compresses files with a registered codec that implements ZipCodec.
+func CreateZipFileCodec(zipPath string, files []string, kind string) error {
+	codec, err := LookupCodec(kind)
+	if err != nil {
+		return err
+	}
+	zc, ok := codec.(ZipCodec)
+	if !ok {
+		return fmt.Errorf("compression type %q is not supported by zip", kind)
+	}
+	method := zc.ZipMethod()
+
 	archive, err := os.Create(zipPath)
 	if err != nil {
 		return err
@@ -19,6 +33,11 @@ func CreateZipFile(zipPath string, files []string) error {
 	defer archive.Close()
 
 	zw := zip.NewWriter(archive)
+	if method != zip.Store && method != zip.Deflate {
+		zw.RegisterCompressor(method, func(w io.Writer) (io.WriteCloser, error) {
+			return zc.NewWriter(w)
+		})
+	}
 
 	for _, file := range files {
 		f, err := os.Open(file)
@@ -26,7 +45,10 @@ func CreateZipFile(zipPath string, files []string) error {
 			return err
 		}
 
-		w, err := zw.Create(filepath.Base(file))
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   filepath.Base(file),
+			Method: method,
+		})
 		if err != nil {
 			f.Close()
 			return err
@@ -44,6 +66,33 @@ func CreateZipFile(zipPath string, files []string) error {
 	return nil
 }
 
+// RegisterZipCodecs makes entries written by CreateZipFileCodec readable.
+func RegisterZipCodecs(r *zip.Reader) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	for _, codec := range codecs {
+		zc, ok := codec.(ZipCodec)
+		if !ok || zc.ZipMethod() == zip.Store || zc.ZipMethod() == zip.Deflate {
+			continue
+		}
+		r.RegisterDecompressor(zc.ZipMethod(), func(r io.Reader) io.ReadCloser {
+			rc, err := zc.NewReader(r)
+			if err != nil {
+				return errReadCloser{err}
+			}
+			return rc
+		})
+	}
+}
+
+type errReadCloser struct {
+	err error
+}
+
+func (r errReadCloser) Read([]byte) (int, error) { return 0, r.err }
+func (r errReadCloser) Close() error             { return nil }
+
 func ZlibPack(buf []byte) ([]byte, error) {
 	var err error
 	var b bytes.Buffer
@@ -71,20 +120,3 @@ func ZlibUnpack(buf []byte) ([]byte, error) {
 	err = r.Close()
 	return out.Bytes(), err
 }
-
-func ZstdPack(buf []byte) ([]byte, error) {
-	// Unless SingleSegment is set, framessizes < 256 are nto stored.
-	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithSingleSegment(len(buf) < 256))
-	if err != nil {
-		return nil, err
-	}
-	return enc.EncodeAll(buf, nil), nil
-}
-
-func ZstdUnpack(buf []byte) ([]byte, error) {
-	dec, err := zstd.NewReader(nil)
-	if err != nil {
-		return nil, err
-	}
-	return dec.DecodeAll(buf, nil)
-}
@@ -0,0 +1,151 @@
+package caches
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoders and the decoder are safe for concurrent EncodeAll/DecodeAll,
+// so one instance per level is shared by all callers.
+var (
+	zstdLock     sync.Mutex
+	zstdEncoders = make(map[zstdEncoderKey]*zstd.Encoder)
+	zstdDecoder  *zstd.Decoder
+
+	zstdWriters = make(map[zstd.EncoderLevel]*sync.Pool)
+	zstdReaders = sync.Pool{
+		New: func() any {
+			dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return dec
+		},
+	}
+)
+
+type zstdEncoderKey struct {
+	level  zstd.EncoderLevel
+	single bool
+}
+
+func zstdEncoder(level zstd.EncoderLevel, size int) (*zstd.Encoder, error) {
+	// Unless SingleSegment is set, frame sizes < 256 are not stored.
+	key := zstdEncoderKey{level: level, single: size < 256}
+
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+
+	if enc, ok := zstdEncoders[key]; ok {
+		return enc, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	if key.single {
+		opts = append(opts, zstd.WithSingleSegment(true))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[key] = enc
+	return enc, nil
+}
+
+func sharedZstdDecoder() (*zstd.Decoder, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+
+	if zstdDecoder == nil {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			return nil, err
+		}
+		zstdDecoder = dec
+	}
+	return zstdDecoder, nil
+}
+
+func ZstdPack(buf []byte) ([]byte, error) {
+	return ZstdPackLevel(buf, zstd.SpeedBestCompression)
+}
+
+func ZstdPackLevel(buf []byte, level zstd.EncoderLevel) ([]byte, error) {
+	enc, err := zstdEncoder(level, len(buf))
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(buf, nil), nil
+}
+
+func ZstdUnpack(buf []byte) ([]byte, error) {
+	dec, err := sharedZstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(buf, nil)
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+// Close flushes the frame and returns the encoder to the pool.
+func (w *zstdWriter) Close() error {
+	if w.Encoder == nil {
+		return nil
+	}
+	err := w.Encoder.Close()
+	w.Encoder.Reset(nil)
+	w.pool.Put(w.Encoder)
+	w.Encoder = nil
+	return err
+}
+
+// NewZstdWriter returns a pooled streaming encoder, it must be closed.
+func NewZstdWriter(w io.Writer, level zstd.EncoderLevel) (io.WriteCloser, error) {
+	zstdLock.Lock()
+	pool, ok := zstdWriters[level]
+	if !ok {
+		pool = &sync.Pool{}
+		zstdWriters[level] = pool
+	}
+	zstdLock.Unlock()
+
+	enc, _ := pool.Get().(*zstd.Encoder)
+	if enc == nil {
+		var err error
+		if enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	}
+	enc.Reset(w)
+	return &zstdWriter{Encoder: enc, pool: pool}, nil
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+// Close returns the decoder to the pool.
+func (r *zstdReader) Close() error {
+	if r.Decoder == nil {
+		return nil
+	}
+	r.Decoder.Reset(nil)
+	zstdReaders.Put(r.Decoder)
+	r.Decoder = nil
+	return nil
+}
+
+// NewZstdReader returns a pooled streaming decoder, it must be closed.
+func NewZstdReader(r io.Reader) (io.ReadCloser, error) {
+	dec := zstdReaders.Get().(*zstd.Decoder)
+	if err := dec.Reset(r); err != nil {
+		zstdReaders.Put(dec)
+		return nil, err
+	}
+	return &zstdReader{Decoder: dec}, nil
+}
@@ -1,14 +1,30 @@
 package goutils
 
 import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/radozd/goutils/caches"
 	"github.com/radozd/goutils/collections"
 	"github.com/radozd/goutils/logger"
 	"github.com/radozd/goutils/vt100"
+	"github.com/radozd/goutils/www"
 )
 
 func TestProcessInfo(t *testing.T) {
@@ -41,9 +57,1130 @@ func TestZstd(t *testing.T) {
 	//os.WriteFile("/Users/ko/Dev/goutils.go/test3.zst", bytes, os.ModePerm)
 }
 
+func TestZstdStream(t *testing.T) {
+	str := "test data test data test data test data test data test data"
+	var buf strings.Builder
+	w, _ := caches.NewZstdWriter(&buf, zstd.SpeedFastest)
+	w.Write([]byte(str))
+	w.Close()
+	r, _ := caches.NewZstdReader(strings.NewReader(buf.String()))
+	unp, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || str != string(unp) {
+		t.Error("zstd stream: no match", err)
+	}
+}
+
 func TestUniq(t *testing.T) {
 	sl := collections.MergeSlices([]string{"1", "2", "3"}, []string{"2", "3", "4"})
 	if len(sl) != 4 || sl[0] != "1" || sl[1] != "2" || sl[2] != "3" || sl[3] != "4" {
 		t.Error("bad merge:", sl)
 	}
 }
+
+func TestPermanentCacheTTL(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "ttl.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Put("forever", "", []byte("data"), "zstd")
+	c.PutTTL("short", "", []byte("data"), "zstd", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if ok, _ := c.Contains("short"); ok {
+		t.Error("ttl: expired entry is visible")
+	}
+	if data, _ := c.Get("forever"); string(data) != "data" {
+		t.Error("ttl: entry without ttl is lost")
+	}
+	if n, err := c.RemoveExpired(); n != 1 || err != nil {
+		t.Error("ttl: expired entries not removed:", n, err)
+	}
+
+	var id, parent, notused int
+	var plan string
+	c.QueryRow("EXPLAIN QUERY PLAN DELETE FROM cache WHERE expires <= 0").Scan(&id, &parent, &notused, &plan)
+	if !strings.Contains(plan, "cache_expires") {
+		t.Error("ttl: expired rows are scanned:", plan)
+	}
+}
+
+func TestPermanentCacheLRU(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "lru.db"))
+	c.MaxRows = 2
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Put("a", "", []byte("a"), "")
+	time.Sleep(2 * time.Millisecond)
+	c.Put("b", "", []byte("b"), "")
+	time.Sleep(2 * time.Millisecond)
+	c.Get("a")
+	c.Put("c", "", []byte("c"), "")
+
+	keys, _ := c.ListKeys()
+	if ok, _ := c.Contains("b"); ok || len(keys) != 2 {
+		t.Error("lru: least recently used entry is not evicted:", keys)
+	}
+
+	// running totals follow overwrites, rewrites and removes
+	c.Put("a", "", []byte("longer"), "")
+	c.Recompress(context.Background(), "zstd")
+	c.Remove("c")
+	var count, total, statKeys, statSize int64
+	c.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM cache").Scan(&count, &total)
+	c.QueryRow("SELECT keys, size FROM cache_stats").Scan(&statKeys, &statSize)
+	if count != statKeys || total != statSize || count != 1 {
+		t.Error("lru: totals out of sync", count, total, statKeys, statSize)
+	}
+
+	// a failed eviction does not fail the stored put
+	c.Exec("CREATE TRIGGER no_evict BEFORE DELETE ON cache BEGIN SELECT RAISE(ABORT, 'no evict'); END")
+	c.Put("d", "", []byte("d"), "")
+	if err := c.Put("e", "", []byte("e"), ""); err != nil {
+		t.Error("lru: eviction error reported by put:", err)
+	}
+	if data, _ := c.Get("e"); string(data) != "e" {
+		t.Error("lru: put lost", string(data))
+	}
+}
+
+func TestPermanentCacheSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.db")
+	c := caches.NewPermanentCache(path)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.Exec(fmt.Sprintf("PRAGMA user_version=%d;", caches.SchemaVersion()+1))
+	c.Close()
+
+	if err := c.Open(); !errors.Is(err, caches.ErrSchemaTooNew) {
+		t.Error("schema: newer file is not rejected:", err)
+	}
+}
+
+func TestPermanentCacheSchemaUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	// the table as created before schema versioning
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE cache (
+		key     VARCHAR (255) NOT NULL PRIMARY KEY,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		comment VARCHAR (255) NOT NULL,
+		kind    VARCHAR (32) NOT NULL,
+		value   BLOB);
+		INSERT INTO cache (key, comment, kind, value) VALUES ('old', 'legacy', '', X'6F6C64');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := caches.NewPermanentCache(path)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if data, _ := c.Get("old"); string(data) != "old" {
+		t.Error("schema: legacy row lost", string(data))
+	}
+	if comment, _ := c.GetComment("old"); comment != "legacy" {
+		t.Error("schema: legacy comment lost", comment)
+	}
+	var version int
+	c.QueryRow("PRAGMA user_version;").Scan(&version)
+	if version != caches.SchemaVersion() {
+		t.Error("schema: not upgraded", version)
+	}
+	if err := c.Put("new", "", []byte("new"), "zstd"); err != nil {
+		t.Error("schema: put after upgrade", err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	str := "test data test data test data test data test data test data"
+	for _, kind := range caches.Codecs() {
+		codec, _ := caches.LookupCodec(kind)
+		packed, err := codec.Encode([]byte(str))
+		if err != nil {
+			t.Error(kind, err)
+			continue
+		}
+		if unp, err := codec.Decode(packed); err != nil || string(unp) != str {
+			t.Error(kind, ": no match", err)
+		}
+	}
+	if _, err := caches.LookupCodec("nope"); !errors.Is(err, caches.ErrUnknownCodec) {
+		t.Error("codec: unknown kind is not reported:", err)
+	}
+}
+
+var benchData = []byte(strings.Repeat(`{"id": 12345, "name": "test data", "tags": ["a", "b"]}`, 20))
+
+// the way ZstdPack worked before encoders were shared
+func BenchmarkZstdPackFresh(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		enc.EncodeAll(benchData, nil)
+	}
+}
+
+func BenchmarkZstdPack(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		caches.ZstdPack(benchData)
+	}
+}
+
+func BenchmarkZstdPackParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			caches.ZstdPackLevel(benchData, zstd.SpeedDefault)
+		}
+	})
+}
+
+func BenchmarkZstdUnpack(b *testing.B) {
+	packed, _ := caches.ZstdPack(benchData)
+	for i := 0; i < b.N; i++ {
+		caches.ZstdUnpack(packed)
+	}
+}
+
+func BenchmarkZstdWriter(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		w, _ := caches.NewZstdWriter(io.Discard, zstd.SpeedDefault)
+		w.Write(benchData)
+		w.Close()
+	}
+}
+
+func TestPermanentCacheDict(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "dict.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 64; i++ {
+		c.Put(fmt.Sprint("key", i), "", []byte(fmt.Sprintf(`{"id": %d, "name": "item %d", "tags": ["cache", "test"], "ok": true}`, i, i*7)), "zstd")
+	}
+	if _, err := c.TrainDict(64, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Recompress(context.Background(), caches.KindZstdDict); n != 64 || err != nil {
+		t.Error("dict: recompress failed:", n, err)
+	}
+	c.UseDict = true
+	c.Put("new", "", []byte(`{"id": 1000, "name": "item 7000", "tags": ["cache", "test"], "ok": true}`), "zstd")
+	if data, err := c.Get("key5"); err != nil || !strings.Contains(string(data), "item 35") {
+		t.Error("dict: no match", err)
+	}
+	if data, err := c.Get("new"); err != nil || !strings.Contains(string(data), "item 7000") {
+		t.Error("dict: no match", err)
+	}
+}
+
+type typedPoint struct {
+	X, Y int32
+}
+
+func TestTyped(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "typed.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, s := range []caches.Serializer{caches.JSONSerializer{}, caches.GobSerializer{}, caches.BinarySerializer{}} {
+		tc := caches.NewTyped[typedPoint](c, s, "zstd")
+		tc.Put("p", typedPoint{1, 2})
+		if p, ok, err := tc.Get("p"); !ok || err != nil || p.X != 1 || p.Y != 2 {
+			t.Errorf("typed %T: no match %v %v", s, p, err)
+		}
+		if _, ok, err := tc.Get("missing"); ok || err != nil {
+			t.Errorf("typed %T: missing key found", s)
+		}
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "compute.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var calls atomic.Int32
+	load := func() ([]byte, error) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.GetOrCompute(context.Background(), "url", load); err != nil || string(data) != "loaded" {
+				t.Error("compute: no match", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Error("compute: loader called", calls.Load(), "times")
+	}
+
+	_, err := c.GetOrCompute(context.Background(), "panic", func() ([]byte, error) { panic("boom") })
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Error("compute: panic not reported", err)
+	}
+	c.ComputeCompress = "nope"
+	data, err := c.GetOrCompute(context.Background(), "unstored", load)
+	if string(data) != "loaded" || !errors.Is(err, caches.ErrUnknownCodec) {
+		t.Error("compute: store error", string(data), err)
+	}
+
+	// failures of many distinct keys are pruned once expired
+	c.NegativeTTL = time.Millisecond
+	fail := func() ([]byte, error) {
+		calls.Add(1)
+		return nil, errors.New("not found")
+	}
+	for i := range 200 {
+		c.GetOrCompute(context.Background(), fmt.Sprint("missing/", i), fail)
+	}
+	time.Sleep(2 * time.Millisecond)
+	c.NegativeTTL = time.Minute
+	calls.Store(0)
+	c.GetOrCompute(context.Background(), "missing/0", fail)
+	if _, err = c.GetOrCompute(context.Background(), "missing/0", fail); err == nil || calls.Load() != 1 {
+		t.Error("compute: failure not cached", calls.Load(), err)
+	}
+}
+
+func TestPermanentCacheQuery(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "query.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 600; i++ {
+		c.Put(fmt.Sprintf("a/%04d", i), "", []byte("a"), "")
+		c.Put(fmt.Sprintf("b/%04d", i), "", []byte("b"), "zstd")
+	}
+
+	if n, err := c.Count(caches.Query{Prefix: "a/"}); n != 600 || err != nil {
+		t.Error("query: bad count", n, err)
+	}
+	keys := []string{}
+	for key, err := range c.Keys(caches.Query{Prefix: "b/", Order: caches.OrderKeyDesc, Offset: 10, Limit: 300}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != 300 || keys[0] != "b/0589" || keys[299] != "b/0290" {
+		t.Error("query: bad page", len(keys))
+	}
+	for e, err := range c.Entries(caches.Query{Glob: "b/05*", Kinds: []string{"zstd"}}) {
+		if err != nil || string(e.Value) != "b" {
+			t.Error("query: bad entry", e.Key, err)
+		}
+	}
+
+	// rows after Limit are not decoded
+	c.Exec("UPDATE cache SET value=x'00' WHERE key='b/0001'")
+	n := 0
+	for _, err := range c.Entries(caches.Query{Prefix: "b/", Limit: 1}) {
+		if err != nil {
+			t.Error("query: row beyond limit decoded", err)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Error("query: limit ignored", n)
+	}
+}
+
+func TestPermanentCacheBatch(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "batch.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries := make([]caches.Entry, 1000)
+	for i := range entries {
+		entries[i] = caches.Entry{Key: fmt.Sprint(i), Kind: "zstd", Value: []byte(fmt.Sprint("value ", i))}
+	}
+	if err := c.PutMany(entries); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := c.GetMany([]string{"1", "999", "missing"}); err != nil || len(m) != 2 || string(m["999"]) != "value 999" {
+		t.Error("batch: GetMany failed", m, err)
+	}
+	if n, err := c.RemoveMany([]string{"1", "2", "missing"}); n != 2 || err != nil {
+		t.Error("batch: RemoveMany failed", n, err)
+	}
+
+	b, _ := c.NewBatch()
+	b.Put("new", "", []byte("new"), "")
+	b.Remove("3")
+	if data, _ := b.Get("new"); string(data) != "new" {
+		t.Error("batch: own changes are not visible")
+	}
+	b.Rollback()
+	if ok, _ := c.Contains("3"); !ok {
+		t.Error("batch: rollback failed")
+	}
+}
+
+func TestPermanentCacheVerify(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "verify.db"))
+	c.VerifyOnGet = true
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Put("good", "", []byte("good data"), "zstd")
+	c.Put("truncated", "", []byte("good data"), "zstd")
+	c.Put("changed", "", []byte("good data"), "")
+	c.Exec("UPDATE cache SET value=substr(value, 1, 5) WHERE key='truncated'")
+	c.Exec("UPDATE cache SET value=CAST('bad data' AS BLOB) WHERE key='changed'")
+
+	if _, err := c.Get("changed"); !errors.Is(err, caches.ErrCorrupt) {
+		t.Error("verify: checksum mismatch is not reported:", err)
+	}
+	report, err := c.Verify(context.Background(), true)
+	if err != nil || report.Checked != 3 || len(report.Corrupt) != 2 || report.Quarantined != 2 {
+		t.Error("verify: bad report", report, err)
+	}
+	if keys, _ := c.ListKeys(); len(keys) != 1 {
+		t.Error("verify: corrupt entries are not quarantined", keys)
+	}
+}
+
+func TestPermanentCacheEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crypt.db")
+	c := caches.NewPermanentCache(path)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.Put("legacy", "", []byte("personal data"), "")
+	c.Dedup = true
+	c.Put("legacy blob", "", []byte("personal blob"), "")
+	c.Close()
+
+	keys := &caches.StaticKeys{Current: "k1", Keys: map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+		"k2": []byte("fedcba9876543210fedcba9876543210"),
+	}}
+	c.KeyProvider = keys
+	if err := c.Open(); err == nil {
+		t.Fatal("crypt: opened without ChecksumKey")
+	}
+	c.ChecksumKey = []byte("checksum key")
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.VerifyOnGet = true
+	c.Dedup = false
+	c.Put("secret", "", []byte("personal data"), "")
+	c.Put("other", "", []byte("other data"), "")
+
+	keys.Current = "k2"
+	if n, err := c.ReEncrypt(context.Background()); n != 4 || err != nil {
+		t.Error("crypt: re-encrypt failed", n, err)
+	}
+	plain := -1
+	sum := sha256.Sum256([]byte("personal data"))
+	c.QueryRow(`SELECT COUNT(*) FROM entries WHERE value=CAST('personal data' AS BLOB) OR keyid<>'k2' OR checksum=?`, sum[:]).Scan(&plain)
+	if plain != 0 {
+		t.Error("crypt: values are not encrypted", plain)
+	}
+	for key, want := range map[string]string{"legacy": "personal data", "legacy blob": "personal blob", "secret": "personal data"} {
+		if data, err := c.Get(key); err != nil || string(data) != want {
+			t.Error("crypt: no match", key, err)
+		}
+	}
+
+	c.Exec("UPDATE cache SET value=(SELECT value FROM cache WHERE key='other') WHERE key='secret'")
+	if _, err := c.Get("secret"); !errors.Is(err, caches.ErrCorrupt) {
+		t.Error("crypt: swapped value not detected", err)
+	}
+}
+
+func TestPermanentCacheDedup(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "dedup.db"))
+	c.Dedup = true
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	image := []byte(strings.Repeat("image", 100))
+	c.Put("a", "", image, "zstd")
+	c.Put("b", "", image, "zstd")
+	c.Put("c", "", image, "zstd")
+	c.Put("c", "", []byte("other"), "")
+
+	if s, err := c.DedupStats(); err != nil || s.Keys != 3 || s.Blobs != 2 {
+		t.Error("dedup: bad stats", s, err)
+	}
+	if data, err := c.Get("b"); err != nil || string(data) != string(image) {
+		t.Error("dedup: no match", err)
+	}
+	c.RemoveMany([]string{"a", "b", "c"})
+	if s, _ := c.DedupStats(); s.Blobs != 0 {
+		t.Error("dedup: blobs are not collected", s)
+	}
+
+	c.Exec("CREATE TRIGGER fail BEFORE INSERT ON cache WHEN NEW.key='fail' BEGIN SELECT RAISE(ABORT, 'fail'); END")
+	if err := c.Put("fail", "", image, "zstd"); err == nil {
+		t.Fatal("dedup: trigger did not fire")
+	}
+	if s, _ := c.DedupStats(); s.Blobs != 0 {
+		t.Error("dedup: failed put left a blob", s)
+	}
+}
+
+func TestPermanentCacheBackup(t *testing.T) {
+	dir := t.TempDir()
+	c := caches.NewPermanentCache(filepath.Join(dir, "live.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Put("key", "", []byte("before"), "zstd")
+	// rotations within the same second keep their own snapshots
+	var snapshot string
+	for i := 0; i < 3; i++ {
+		var err error
+		if snapshot, err = c.BackupRotate(context.Background(), dir, 2, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, _ := filepath.Glob(filepath.Join(dir, "live-*.db.zst"))
+	if len(list) != 2 || list[1] != snapshot {
+		t.Error("backup: snapshots are not rotated", list)
+	}
+
+	c.Put("key", "", []byte("after"), "zstd")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Backup(context.Background(), filepath.Join(dir, "concurrent.db"))
+	}()
+	if err := c.Restore(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if data, _ := c.Get("key"); string(data) != "before" {
+		t.Error("backup: restore failed", string(data))
+	}
+
+	r := caches.NewPermanentCache(filepath.Join(dir, "live.db"))
+	r.ReadOnly = true
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Restore(context.Background(), snapshot); !errors.Is(err, caches.ErrReadOnly) {
+		t.Error("backup: read-only restore", err)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "tiered.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tc := caches.NewTieredCache(c, 2, caches.WriteBehind)
+	tc.Put("a", "", []byte("a"), "zstd")
+	tc.Put("b", "", []byte("b"), "zstd")
+	tc.Put("c", "", []byte("c"), "zstd")
+	if ok, _ := tc.Remove("b"); !ok {
+		t.Error("tiered: pending key not removed")
+	}
+	if ok, _ := tc.Remove("missing"); ok {
+		t.Error("tiered: missing key removed")
+	}
+
+	if data, _ := tc.Get("a"); string(data) != "a" {
+		t.Error("tiered: pending write is lost")
+	}
+	if ok, _ := c.Contains("a"); ok {
+		t.Error("tiered: write-behind stored too early")
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := c.ListKeys(); len(keys) != 2 {
+		t.Error("tiered: flush failed", keys)
+	}
+
+	tc.Invalidate("a")
+	tc.Get("a")
+	tc.Get("a")
+	// the pending read above is a memory hit too
+	if s := tc.Stats(); s.DiskHits != 1 || s.MemHits != 2 || s.MemMisses != 1 || s.Pending != 0 {
+		t.Errorf("tiered: bad stats %+v", s)
+	}
+
+	c.DefaultTTL = 10 * time.Millisecond
+	tc.Policy = caches.WriteThrough
+	tc.Put("short", "", []byte("v"), "")
+	c.PutTTL("disk", "", []byte("v"), "", 10*time.Millisecond)
+	tc.Get("disk")
+	time.Sleep(30 * time.Millisecond)
+	for _, key := range []string{"short", "disk"} {
+		if data, _ := tc.Get(key); data != nil {
+			t.Error("tiered: expired value served", key)
+		}
+	}
+
+	// a disk read of the old value finishes after Remove
+	c.DefaultTTL = 0
+	c.Put("k", "", []byte("old"), "")
+	b, err := c.NewBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	misses := tc.Stats().MemMisses
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tc.Get("k")
+	}()
+	for tc.Stats().MemMisses == misses {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		tc.Remove("k")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.Rollback()
+	wg.Wait()
+	if data, _ := tc.Get("k"); data != nil {
+		t.Error("tiered: removed value cached again", string(data))
+	}
+}
+
+func TestPermanentCacheMetadata(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "meta.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, site := range []string{"a.com", "a.com", "b.com"} {
+		key := fmt.Sprintf("https://%s/%d", site, i)
+		c.Put(key, "", []byte("page"), "zstd")
+		c.SetTags(key, "site:"+site, "html")
+		c.SetAttrs(key, map[string]any{"source": site, "status": 200})
+	}
+	c.UpdateAttrs("https://b.com/2", map[string]any{"status": 404})
+
+	if n, _ := c.Count(caches.Query{Attrs: map[string]any{"status": 200}}); n != 2 {
+		t.Error("meta: attribute query failed", n)
+	}
+	if n, err := c.RemoveByTag("site:a.com"); n != 2 || err != nil {
+		t.Error("meta: remove by tag failed", n, err)
+	}
+	if tags, _ := c.Tags("https://a.com/0"); len(tags) != 0 {
+		t.Error("meta: tags of removed entry are left", tags)
+	}
+	if err := c.SetTags("missing", "x"); !errors.Is(err, caches.ErrNotFound) {
+		t.Error("meta: missing key is not reported", err)
+	}
+}
+
+func TestPermanentCacheHistory(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "history.db"))
+	c.HistoryDepth = 2
+	c.Dedup = true
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 1; i <= 4; i++ {
+		c.Put("page", fmt.Sprint("v", i), []byte(fmt.Sprint("content ", i)), "zstd")
+	}
+	versions, err := c.ListVersions("page")
+	if err != nil || len(versions) != 2 || versions[0].Version != 2 || versions[1].Comment != "v3" {
+		t.Error("history: bad versions", versions, err)
+	}
+	if data, err := c.GetVersion("page", 2); err != nil || string(data) != "content 2" {
+		t.Error("history: no match", string(data), err)
+	}
+	if err := c.Rollback("page", 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := c.Get("page"); string(data) != "content 3" {
+		t.Error("history: rollback failed", string(data))
+	}
+	if n, err := c.PruneHistory(1, 0); n != 1 || err != nil {
+		t.Error("history: prune failed", n, err)
+	}
+	if s, _ := c.DedupStats(); s.Blobs != 2 {
+		t.Error("history: blobs referenced by history are lost", s)
+	}
+}
+
+func TestPermanentCacheHistoryRewrite(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "history-rewrite.db"))
+	c.HistoryDepth = 3
+	keys := &caches.StaticKeys{Current: "old", Keys: map[string][]byte{
+		"old": []byte("0123456789abcdef0123456789abcdef"),
+		"new": []byte("fedcba9876543210fedcba9876543210"),
+	}}
+	c.KeyProvider = keys
+	c.ChecksumKey = []byte("checksum key")
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 1; i <= 3; i++ {
+		c.Put("page", "", []byte(fmt.Sprint("content ", i)), "zstd")
+	}
+	keys.Current = "new"
+	if n, err := c.ReEncrypt(context.Background()); n != 3 || err != nil {
+		t.Error("history: re-encrypt", n, err)
+	}
+	delete(keys.Keys, "old")
+	if data, err := c.GetVersion("page", 1); err != nil || string(data) != "content 1" {
+		t.Error("history: version lost after key rotation", string(data), err)
+	}
+
+	c.Exec("UPDATE history SET value=X'00' WHERE version=2")
+	report, err := c.Verify(context.Background(), true)
+	if err != nil || report.Checked != 3 || report.Quarantined != 1 || report.Corrupt[0].Version != 2 {
+		t.Error("history: corrupt version not found", report, err)
+	}
+}
+
+func TestPermanentCacheWatch(t *testing.T) {
+	c := caches.NewPermanentCache(filepath.Join(t.TempDir(), "watch.db"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := c.Watch(ctx, "user/")
+
+	c.Put("user/1", "", []byte("a"), "")
+	c.Put("other", "", []byte("b"), "")
+	c.PutTTL("user/2", "", []byte("c"), "", time.Millisecond)
+	c.Remove("user/1")
+	time.Sleep(5 * time.Millisecond)
+	c.RemoveExpired()
+	cancel()
+
+	var got []string
+	for e := range events {
+		got = append(got, string(e.Type)+" "+e.Key)
+	}
+	want := "put user/1,put user/2,remove user/1,expire user/2"
+	if strings.Join(got, ",") != want {
+		t.Error("watch: bad events", got)
+	}
+}
+
+func TestKVHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.db")
+	c := caches.NewPermanentCache(path)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	srv := httptest.NewServer(www.NewKVHandler(c))
+	defer srv.Close()
+
+	do := func(method string, path string, body string, hdr ...string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	payload := strings.Repeat("hello kv ", 100)
+	if res := do("PUT", "/kv/dir/a?compress=gzip", payload, "X-Cache-Comment", "first"); res.StatusCode != http.StatusNoContent {
+		t.Fatal("kv: put failed", res.Status)
+	}
+	do("PUT", "/kv/dir/b", "b", "X-Cache-Tags", "x,y")
+
+	res := do("GET", "/kv/dir/a", "", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("X-Cache-Comment") != "first" {
+		t.Error("kv: no passthrough", res.Header)
+	}
+	gzipTag := res.Header.Get("ETag")
+	// the transport asks for gzip by itself
+	res = do("GET", "/kv/dir/a", "", "Accept-Encoding", "identity")
+	data, _ := io.ReadAll(res.Body)
+	if string(data) != payload || res.Header.Get("Content-Encoding") != "" {
+		t.Error("kv: bad value", len(data))
+	}
+	etag := res.Header.Get("ETag")
+	if etag == gzipTag || !strings.HasSuffix(gzipTag, `-gzip"`) {
+		t.Error("kv: same etag for both codings", etag, gzipTag)
+	}
+	if res = do("GET", "/kv/dir/a", "", "If-None-Match", etag, "Accept-Encoding", "identity"); res.StatusCode != http.StatusNotModified {
+		t.Error("kv: etag ignored", res.Status)
+	}
+	if res = do("GET", "/kv/dir/a", "", "If-None-Match", etag, "Accept-Encoding", "gzip"); res.StatusCode != http.StatusOK {
+		t.Error("kv: decoded etag matched the gzip body", res.Status)
+	}
+
+	// a failed tag insert leaves the old value
+	c.DB.Exec("CREATE TRIGGER no_bad_tags BEFORE INSERT ON tags WHEN NEW.tag='bad' BEGIN SELECT RAISE(ABORT, 'bad tag'); END")
+	if res = do("PUT", "/kv/dir/b", "new", "X-Cache-Tags", "bad"); res.StatusCode != http.StatusInternalServerError {
+		t.Error("kv: bad tag stored", res.Status)
+	}
+	if data, _ := c.Get("dir/b"); string(data) != "b" {
+		t.Error("kv: value changed by a failed put", string(data))
+	}
+
+	res = do("GET", "/kv/?prefix=dir/&limit=1", "")
+	data, _ = io.ReadAll(res.Body)
+	if string(data) != `{"keys":["dir/a"],"next":1}` {
+		t.Error("kv: bad list", string(data))
+	}
+	if res = do("DELETE", "/kv/dir/a", ""); res.StatusCode != http.StatusNoContent {
+		t.Error("kv: delete failed", res.Status)
+	}
+	if res = do("HEAD", "/kv/dir/a", ""); res.StatusCode != http.StatusNotFound {
+		t.Error("kv: deleted key found", res.Status)
+	}
+
+	r := caches.NewPermanentCache(path)
+	r.ReadOnly = true
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ro := httptest.NewServer(www.NewKVHandler(r))
+	defer ro.Close()
+	req, _ := http.NewRequest("PUT", ro.URL+"/kv/x", strings.NewReader("x"))
+	if res, err := http.DefaultTransport.RoundTrip(req); err != nil || res.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("kv: read-only cache", res, err)
+	}
+}
+
+func TestPermanentCacheOpenModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "modes.db")
+	w := caches.NewPermanentCache(path)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Put("a", "", []byte("1"), "")
+
+	r := caches.NewPermanentCache(path)
+	r.ReadOnly = true
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := r.Get("a"); string(data) != "1" {
+		t.Error("modes: read-only get failed", string(data))
+	}
+	if err := r.Put("b", "", nil, ""); !errors.Is(err, caches.ErrReadOnly) {
+		t.Error("modes: read-only put", err)
+	}
+	if err := r.SetTags("a", "x"); !errors.Is(err, caches.ErrReadOnly) {
+		t.Error("modes: read-only tags", err)
+	}
+	if _, err := r.Verify(context.Background(), true); !errors.Is(err, caches.ErrReadOnly) {
+		t.Error("modes: read-only quarantine", err)
+	}
+
+	b, err := w.NewBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Rollback()
+
+	other := caches.NewPermanentCache(path)
+	other.BusyTimeout = 10 * time.Millisecond
+	other.BusyRetries = 1
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Put("c", "", nil, ""); !errors.Is(err, caches.ErrBusy) {
+		t.Error("modes: writer not detected", err)
+	}
+	if err := other.SetComment("a", "c"); !errors.Is(err, caches.ErrBusy) {
+		t.Error("modes: comment writer not detected", err)
+	}
+	// readers are not blocked by the writer
+	if res, err := other.GetMany([]string{"a"}); err != nil || string(res["a"]) != "1" {
+		t.Error("modes: get many while locked", res, err)
+	}
+}
+
+func TestTarCacheIndex(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "index.tar")
+	c := caches.NewTarCache(name)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.PutBytes("a", []byte("first"))
+	c.Codec = "zstd"
+	c.PutBytes("a", []byte("second"))
+	c.PutBytes("b", []byte("bbb"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reopen := range []string{"sidecar", "scan"} {
+		if reopen == "scan" {
+			os.Remove(c.IndexPath)
+		}
+		c = caches.NewTarCache(name)
+		if err := c.Open(); err != nil {
+			t.Fatal(err)
+		}
+		first, _ := c.GetBytes("a", true)
+		last, _ := c.GetBytes("a", false)
+		files, _ := c.ListFiles()
+		if string(first) != "first" || string(last) != "second" || len(files) != 2 {
+			t.Error("tar index:", reopen, string(first), string(last), files)
+		}
+		c.Close()
+	}
+}
+
+// writeTestTar writes an archive like tar -cf of a directory
+// with a pax global header, a directory, a symlink and a file.
+func writeTestTar(t *testing.T, name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "test"}, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeDir, Name: "sub/", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "sub/link", Linkname: "f", Mode: 0777},
+		{Typeflag: tar.TypeReg, Name: "sub/f", Mode: 0644, Size: 4},
+	}
+	for _, hdr := range headers {
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Write([]byte("file"))
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestTarCacheTypes(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "types.tar")
+	writeTestTar(t, name)
+
+	c := caches.NewTarCache(name)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	files, _ := c.ListFiles()
+	if len(files) != 1 || files[0] != "sub/f" {
+		t.Error("tar types: files", files)
+	}
+	for _, skipped := range []string{"pax_global_header", "sub/", "sub/link"} {
+		if data, _ := c.GetBytes(skipped, false); data != nil {
+			t.Error("tar types: non-regular entry read", skipped)
+		}
+	}
+	if data, _ := c.GetBytes("sub/f", false); string(data) != "file" {
+		t.Error("tar types: file", string(data))
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := c.ExtractTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "sub", "f")); string(data) != "file" {
+		t.Error("tar types: extract failed", string(data))
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "sub", "link")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("tar types: link extracted", err)
+	}
+}
+
+func TestTarCacheCompact(t *testing.T) {
+	c := caches.NewTarCache(filepath.Join(t.TempDir(), "compact.tar"))
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := range 3 {
+		c.PutBytes("a", []byte(strings.Repeat(fmt.Sprint(i), 1000)))
+		c.PutBytes(fmt.Sprint("b", i), []byte("b"))
+	}
+	reclaimed, err := c.Compact(context.Background(), false)
+	if err != nil || reclaimed != 2*(512+1024) {
+		t.Error("compact: reclaimed", reclaimed, err)
+	}
+	if data, _ := c.GetBytes("a", true); string(data) != strings.Repeat("2", 1000) {
+		t.Error("compact: lost the last version", string(data))
+	}
+	c.PutBytes("c", []byte("c"))
+	if files, _ := c.ListFiles(); len(files) != 5 {
+		t.Error("compact: bad files", files)
+	}
+}
+
+func TestTarCacheRemove(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "remove.tar")
+	c := caches.NewTarCache(name)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.PutBytes("a", []byte("a1"))
+	c.PutBytes("b", []byte("b1"))
+	if removed, err := c.Remove("a"); !removed || err != nil {
+		t.Fatal("tar remove:", removed, err)
+	}
+	if removed, _ := c.Remove("a"); removed {
+		t.Error("tar remove: removed twice")
+	}
+	if data, _ := c.GetBytes("a", true); data != nil {
+		t.Error("tar remove: removed file found")
+	}
+	c.PutBytes("a", []byte("a2"))
+	if data, _ := c.GetBytes("a", true); string(data) != "a2" {
+		t.Error("tar remove: versions before remove are visible", string(data))
+	}
+
+	c.Remove("b")
+	c.Compact(context.Background(), false)
+	c.Close()
+	os.Remove(c.IndexPath)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := c.ListFiles(); len(files) != 1 || files[0] != "a" {
+		t.Error("tar remove: bad files after compact", files)
+	}
+}
+
+func TestTarCacheRepair(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "repair.tar")
+	c := caches.NewTarCache(name)
+	c.Sync = true
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.PutBytes("a", []byte("complete"))
+	c.PutBytes("b", []byte(strings.Repeat("b", 2000)))
+	c.Close()
+
+	// torn append: the data of b is cut
+	os.Truncate(name, 512+512+512+1000)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.PutBytes("c", []byte("after crash"))
+	if files, _ := c.ListFiles(); len(files) != 2 {
+		t.Error("repair: torn entry kept", files)
+	}
+	c.Close()
+
+	// damaged header in the middle
+	f, _ := os.OpenFile(name, os.O_RDWR, 0)
+	f.WriteAt([]byte("garbage"), 1024)
+	f.Close()
+	if err := c.Open(); err == nil {
+		t.Fatal("repair: damaged header not detected")
+	}
+	if n, err := c.Repair(); n != 512+512+1024 || err != nil {
+		t.Error("repair: discarded", n, err)
+	}
+	defer c.Close()
+	if data, _ := c.GetBytes("a", false); string(data) != "complete" {
+		t.Error("repair: lost complete entry", string(data))
+	}
+}
+
+func TestTarCacheStream(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "top.txt"), []byte("top"), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "big.bin"), []byte(strings.Repeat("big ", 100000)), 0644)
+
+	c := caches.NewTarCache(filepath.Join(tmp, "stream.tar"))
+	c.Codec = "zstd"
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.PutDir(src); err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.Repeat("x", 5000)
+	if err := c.PutReader("stream/x", int64(len(payload)), time.Now(), strings.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, fi, err := c.OpenFile("sub/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, r)
+	r.Close()
+	if n != 400000 || fi.Size() != n || fi.Name() != "big.bin" {
+		t.Error("stream: bad file", n, fi.Size(), fi.Name())
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	if err = c.ExtractTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "stream", "x")); string(data) != payload {
+		t.Error("stream: extract failed", len(data))
+	}
+
+	c.PutBytes("../escape", []byte("x"))
+	if err = c.ExtractTo(dst); err == nil {
+		t.Error("stream: path traversal not detected")
+	}
+}
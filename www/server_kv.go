@@ -0,0 +1,299 @@
+package www
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/radozd/goutils/caches"
+)
+
+// KVHandler serves a PermanentCache as a key-value api:
+//
+//	GET|HEAD /kv/{key}  value, comment in X-Cache-Comment
+//	PUT /kv/{key}       ?compress=zstd&ttl=1h, X-Cache-Comment, X-Cache-Tags, X-Cache-Attrs
+//	DELETE /kv/{key}
+//	GET /kv/            ?prefix=&offset=&limit=, json {"keys":[...],"next":N}
+//
+// Header values are url-escaped. ServeMux cleans paths, so a key with "//"
+// or "/./" gets a 307 redirect to the cleaned key unless the slashes are
+// percent-encoded. The cache returns 503 when another process holds
+// the write lock and 405 when it is read-only.
+type KVHandler struct {
+	Cache *caches.PermanentCache
+	// Compress is used for PUT without ?compress
+	Compress string
+	// MaxSize limits PUT body, zero means no limit.
+	MaxSize  int64
+	ReadOnly bool
+	// ListLimit is the default and max page size of the key list.
+	ListLimit int
+
+	mux *http.ServeMux
+}
+
+// codecs which are valid http content codings
+var kvContentEncoding = map[string]string{
+	"gzip": "gzip",
+	"zlib": "deflate",
+	"zstd": "zstd",
+}
+
+func NewKVHandler(c *caches.PermanentCache) *KVHandler {
+	h := &KVHandler{Cache: c, Compress: "zstd", ListLimit: 1000}
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("GET /kv/{$}", h.list)
+	h.mux.HandleFunc("GET /kv/{key...}", h.get)
+	h.mux.HandleFunc("PUT /kv/{key...}", h.put)
+	h.mux.HandleFunc("DELETE /kv/{key...}", h.remove)
+	return h
+}
+
+func (h *KVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer PanicHandler(w)
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *KVHandler) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	e, found, err := h.Cache.Raw(key)
+	if err != nil {
+		kvError(w, err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/octet-stream")
+	hdr.Set("Vary", "Accept-Encoding")
+	hdr.Set("Last-Modified", e.Created.UTC().Format(http.TimeFormat))
+	if !e.Expires.IsZero() {
+		hdr.Set("Expires", e.Expires.UTC().Format(http.TimeFormat))
+	}
+	if e.Comment != "" {
+		hdr.Set("X-Cache-Comment", url.QueryEscape(e.Comment))
+	}
+	hdr.Set("X-Cache-Kind", e.Kind)
+	if tags, err := h.Cache.Tags(key); err == nil && len(tags) > 0 {
+		for i := range tags {
+			tags[i] = url.QueryEscape(tags[i])
+		}
+		hdr.Set("X-Cache-Tags", strings.Join(tags, ","))
+	}
+	if attrs, err := h.Cache.Attrs(key); err == nil && len(attrs) > 0 {
+		buf, _ := json.Marshal(attrs)
+		hdr.Set("X-Cache-Attrs", url.QueryEscape(string(buf)))
+	}
+
+	// stored bytes are sent as is if the client accepts the coding
+	enc, ok := kvContentEncoding[e.Kind]
+	passthrough := ok && acceptsEncoding(r.Header.Get("Accept-Encoding"), enc)
+
+	// each representation has its own etag
+	if e.Checksum != nil {
+		etag := hex.EncodeToString(e.Checksum)
+		if passthrough {
+			etag += "-" + enc
+		}
+		etag = `"` + etag + `"`
+		hdr.Set("ETag", etag)
+		if matchETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	data := e.Value
+	if passthrough {
+		hdr.Set("Content-Encoding", enc)
+	} else if e.Kind != "" {
+		if data, err = h.Cache.Decode(e.Kind, e.Value); err != nil {
+			kvError(w, err)
+			return
+		}
+	}
+	hdr.Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+func (h *KVHandler) put(w http.ResponseWriter, r *http.Request) {
+	if h.ReadOnly {
+		http.Error(w, "read only", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.PathValue("key")
+
+	query := r.URL.Query()
+	compress := h.Compress
+	if query.Has("compress") {
+		compress = query.Get("compress")
+	}
+	if _, err := caches.LookupCodec(compress); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := h.Cache.DefaultTTL
+	if s := query.Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	comment, _ := url.QueryUnescape(r.Header.Get("X-Cache-Comment"))
+
+	var attrs map[string]any
+	if s := r.Header.Get("X-Cache-Attrs"); s != "" {
+		s, _ = url.QueryUnescape(s)
+		if err := json.Unmarshal([]byte(s), &attrs); err != nil {
+			http.Error(w, "bad X-Cache-Attrs: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var tags []string
+	if s := r.Header.Get("X-Cache-Tags"); s != "" {
+		tags = make([]string, 0)
+		for _, tag := range strings.Split(s, ",") {
+			if tag, _ = url.QueryUnescape(strings.TrimSpace(tag)); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	body := r.Body
+	if h.MaxSize > 0 {
+		body = http.MaxBytesReader(w, body, h.MaxSize)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	// the value, tags and attrs are stored together or not at all
+	b, err := h.Cache.NewBatch()
+	if err != nil {
+		kvError(w, err)
+		return
+	}
+	err = b.PutTTL(key, comment, data, compress, ttl)
+	if err == nil && tags != nil {
+		err = b.SetTags(key, tags...)
+	}
+	if err == nil && attrs != nil {
+		err = b.SetAttrs(key, attrs)
+	}
+	if err != nil {
+		b.Rollback()
+		kvError(w, err)
+		return
+	}
+	if err = b.Commit(); err != nil {
+		kvError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *KVHandler) remove(w http.ResponseWriter, r *http.Request) {
+	if h.ReadOnly {
+		http.Error(w, "read only", http.StatusMethodNotAllowed)
+		return
+	}
+	removed, err := h.Cache.Remove(r.PathValue("key"))
+	if err != nil {
+		kvError(w, err)
+		return
+	}
+	if !removed {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *KVHandler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || (h.ListLimit > 0 && limit > h.ListLimit) {
+		limit = h.ListLimit
+	}
+
+	q := caches.Query{Prefix: query.Get("prefix"), Offset: max(offset, 0), Order: caches.OrderKey}
+	if limit > 0 {
+		// one more to know if there is a next page
+		q.Limit = limit + 1
+	}
+	keys := make([]string, 0)
+	for key, err := range h.Cache.Keys(q) {
+		if err != nil {
+			kvError(w, err)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	res := map[string]interface{}{}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		res["next"] = q.Offset + limit
+	}
+	res["keys"] = keys
+
+	buffer, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buffer)
+}
+
+func kvError(w http.ResponseWriter, err error) {
+	log.Println("WWW: kv:", err)
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, caches.ErrBusy):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, caches.ErrReadOnly):
+		code = http.StatusMethodNotAllowed
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func matchETag(header string, etag string) bool {
+	for _, s := range strings.Split(header, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+		if s == etag || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding checks Accept-Encoding ignoring weights except q=0.
+func acceptsEncoding(header string, enc string) bool {
+	for _, s := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(s), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return !strings.HasPrefix(q, "q=0") || strings.Trim(q[2:], "0.") != ""
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package www
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/radozd/goutils/caches"
+)
+
+// WatchCache forwards cache changes under prefix to all SSE clients
+// as json {"event":"put","key":"...","time":"..."} until ctx is done.
+func (b *SseBroker) WatchCache(ctx context.Context, c *caches.PermanentCache, prefix string) {
+	events := c.Watch(ctx, prefix)
+	go func() {
+		for e := range events {
+			buffer, _ := json.Marshal(e)
+			b.SendMessage(string(buffer))
+		}
+	}()
+}